@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	core "github.com/Exca-DK/go-mempipe/core"
+	"github.com/Exca-DK/go-mempipe/core/links"
+)
+
+// Every case runs its writer and reader in their own process, started from this
+// binary with -role. Each message carries the writer's CLOCK_MONOTONIC reading in
+// its first 8 bytes, the reader reports the latencies it saw as JSON on stdout.
+var transports = map[string]bool{"mempipe": true, "unix": true, "pipe": true, "tcp": true}
+
+type benchCase struct {
+	Transport string
+	Size      int
+	Rate      int // messages per second, 0 sends as fast as possible
+	N         int
+	Warmup    int
+	Addr      string
+}
+
+type benchResult struct {
+	Latency *hdrHistogram
+	Elapsed time.Duration // between the first and the last measured message
+}
+
+func bench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	sizes := fs.String("sizes", "64,1024,16384", "comma separated payload sizes in bytes")
+	rates := fs.String("rates", "0", "comma separated send rates in messages per second, 0 is unpaced")
+	n := fs.Int("n", 100000, "measured messages per case")
+	warmup := fs.Int("warmup", 1000, "messages sent before measuring")
+	compare := fs.Bool("compare", false, "also run over unix sockets, pipes and loopback tcp")
+	only := fs.String("transports", "mempipe", "comma separated transports: mempipe, unix, pipe, tcp")
+
+	role := fs.String("role", "", "internal: writer or reader")
+	var c benchCase
+	fs.StringVar(&c.Transport, "transport", "", "internal")
+	fs.IntVar(&c.Size, "size", 0, "internal")
+	fs.IntVar(&c.Rate, "rate", 0, "internal")
+	fs.StringVar(&c.Addr, "addr", "", "internal")
+	fs.Parse(args)
+
+	c.N, c.Warmup = *n, *warmup
+	switch *role {
+	case "writer":
+		return benchWriter(c)
+	case "reader":
+		return benchReader(c)
+	}
+
+	list := *only
+	if *compare {
+		list = "mempipe,unix,pipe,tcp"
+	}
+	var names []string
+	for _, t := range strings.Split(list, ",") {
+		if !transports[t] {
+			return fmt.Errorf("unknown transport %q", t)
+		}
+		names = append(names, t)
+	}
+	sizeList, err := parseInts(*sizes, 8)
+	if err != nil {
+		return err
+	}
+	rateList, err := parseInts(*rates, 0)
+	if err != nil {
+		return err
+	}
+
+	const row = "%-9s %7v %7v %9v %8v %10v %10v %10v %10v\n"
+	fmt.Printf(row, "TRANSPORT", "SIZE", "RATE", "MSGS/S", "MB/S", "P50", "P99", "P99.9", "MAX")
+	for _, size := range sizeList {
+		for _, rate := range rateList {
+			for _, t := range names {
+				c.Transport, c.Size, c.Rate = t, size, rate
+				res, err := runBenchCase(c)
+				if err != nil {
+					return fmt.Errorf("%s, %d bytes: %w", t, size, err)
+				}
+
+				msgs := float64(res.Latency.Total) / res.Elapsed.Seconds()
+				h := res.Latency
+				fmt.Printf(row, t, size, formatRate(rate),
+					fmt.Sprintf("%.0f", msgs), fmt.Sprintf("%.1f", msgs*float64(size)/1e6),
+					us(h.quantile(0.5)), us(h.quantile(0.99)), us(h.quantile(0.999)), us(h.Max))
+			}
+		}
+	}
+	return nil
+}
+
+// runBenchCase sets up the transport, starts both processes and collects the reader's result.
+func runBenchCase(c benchCase) (benchResult, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return benchResult{}, err
+	}
+
+	// files handed to the processes as fd 3
+	var readerFile, writerFile *os.File
+	switch c.Transport {
+	case "mempipe":
+		var b [4]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return benchResult{}, err
+		}
+		c.Addr = strconv.FormatUint(uint64(binary.BigEndian.Uint32(b[:])>>1), 10)
+	case "pipe":
+		if readerFile, writerFile, err = os.Pipe(); err != nil {
+			return benchResult{}, err
+		}
+	case "unix", "tcp":
+		addr := "127.0.0.1:0"
+		if c.Transport == "unix" {
+			addr = filepath.Join(os.TempDir(), fmt.Sprintf("mempipe-bench-%d.sock", os.Getpid()))
+			defer os.Remove(addr)
+		}
+		l, err := net.Listen(c.Transport, addr)
+		if err != nil {
+			return benchResult{}, err
+		}
+		defer l.Close()
+		c.Addr = l.Addr().String()
+		if readerFile, err = l.(interface{ File() (*os.File, error) }).File(); err != nil {
+			return benchResult{}, err
+		}
+	}
+
+	var out bytes.Buffer
+	reader := benchCommand(exe, "reader", c, readerFile)
+	reader.Stdout = &out
+	writer := benchCommand(exe, "writer", c, writerFile)
+	if err := reader.Start(); err != nil {
+		return benchResult{}, err
+	}
+	if err := writer.Start(); err != nil {
+		reader.Process.Kill()
+		reader.Wait()
+		return benchResult{}, err
+	}
+	// our copies would keep the pipe open after the writer exits
+	for _, f := range []*os.File{readerFile, writerFile} {
+		if f != nil {
+			f.Close()
+		}
+	}
+
+	if err := writer.Wait(); err != nil {
+		reader.Process.Kill()
+		reader.Wait()
+		return benchResult{}, fmt.Errorf("writer: %w", err)
+	}
+	if err := reader.Wait(); err != nil {
+		return benchResult{}, fmt.Errorf("reader: %w", err)
+	}
+
+	var res benchResult
+	if err := json.Unmarshal(out.Bytes(), &res); err != nil {
+		return benchResult{}, err
+	}
+	return res, nil
+}
+
+func benchCommand(exe, role string, c benchCase, f *os.File) *exec.Cmd {
+	cmd := exec.Command(exe, "bench", "-role", role, "-transport", c.Transport,
+		"-size", strconv.Itoa(c.Size), "-rate", strconv.Itoa(c.Rate),
+		"-n", strconv.Itoa(c.N), "-warmup", strconv.Itoa(c.Warmup), "-addr", c.Addr)
+	cmd.Stderr = os.Stderr
+	if f != nil {
+		cmd.ExtraFiles = []*os.File{f}
+	}
+	return cmd
+}
+
+func benchWriter(c benchCase) error {
+	send, closer, err := openBenchWriter(c)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	payload := make([]byte, c.Size)
+	var interval int64
+	if c.Rate > 0 {
+		interval = int64(time.Second) / int64(c.Rate)
+	}
+
+	next := links.Nanotime()
+	for i := 0; i < c.Warmup+c.N; i++ {
+		if interval > 0 {
+			for links.Nanotime() < next {
+				links.Wait()
+			}
+			next += interval
+		}
+
+		binary.LittleEndian.PutUint64(payload, uint64(links.Nanotime()))
+		if err := send(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func benchReader(c benchCase) error {
+	recv, closer, err := openBenchReader(c)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	res := benchResult{Latency: newHdrHistogram()}
+	buf := make([]byte, c.Size)
+	var first int64
+	for i := 0; i < c.Warmup+c.N; i++ {
+		payload, err := recv(buf)
+		if err != nil {
+			return err
+		}
+		now := links.Nanotime()
+		if i < c.Warmup {
+			continue
+		}
+		if i == c.Warmup {
+			first = now
+		}
+		res.Latency.record(uint64(now - int64(binary.LittleEndian.Uint64(payload))))
+		res.Elapsed = time.Duration(now - first)
+	}
+	if res.Elapsed == 0 {
+		res.Elapsed = 1
+	}
+	return json.NewEncoder(os.Stdout).Encode(res)
+}
+
+func openBenchWriter(c benchCase) (func([]byte) error, func(), error) {
+	if c.Transport == "mempipe" {
+		key, _ := strconv.ParseInt(c.Addr, 10, 64)
+		p, err := core.NewMemWritePipe(key, uint64(c.Size)+1024)
+		if err != nil {
+			return nil, nil, err
+		}
+		p.WaitConn()
+		p.SetWriteDeadline(10 * time.Second)
+		send := func(b []byte) error {
+			return p.WriteMsg(core.NewMessage(1, b, len(b)))
+		}
+		return send, p.Close, nil
+	}
+
+	var conn io.WriteCloser
+	var err error
+	if c.Transport == "pipe" {
+		conn = os.NewFile(3, "pipe")
+	} else if conn, err = net.Dial(c.Transport, c.Addr); err != nil {
+		return nil, nil, err
+	}
+
+	// length prefixed like a frame, written with a single syscall
+	frame := make([]byte, 4+c.Size)
+	send := func(b []byte) error {
+		binary.BigEndian.PutUint32(frame, uint32(len(b)))
+		copy(frame[4:], b)
+		_, err := conn.Write(frame)
+		return err
+	}
+	return send, func() { conn.Close() }, nil
+}
+
+func openBenchReader(c benchCase) (func([]byte) ([]byte, error), func(), error) {
+	if c.Transport == "mempipe" {
+		key, _ := strconv.ParseInt(c.Addr, 10, 64)
+		var p core.Pipe
+		var err error
+		// the writer creates the segment
+		for ts := time.Now(); ; time.Sleep(time.Millisecond) {
+			if p, err = core.NewMemReadPipe(key, uint64(c.Size)+1024); err == nil {
+				break
+			}
+			if time.Since(ts) > 5*time.Second {
+				return nil, nil, err
+			}
+		}
+		recv := func([]byte) ([]byte, error) {
+			msg, err := p.ReadMsg()
+			return msg.Payload, err
+		}
+		return recv, p.Close, nil
+	}
+
+	var conn io.ReadCloser
+	if c.Transport == "pipe" {
+		conn = os.NewFile(3, "pipe")
+	} else {
+		l, err := net.FileListener(os.NewFile(3, "listener"))
+		if err != nil {
+			return nil, nil, err
+		}
+		defer l.Close()
+		if conn, err = l.Accept(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var hdr [4]byte
+	recv := func(buf []byte) ([]byte, error) {
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			return nil, err
+		}
+		n := int(binary.BigEndian.Uint32(hdr[:]))
+		if n > len(buf) {
+			return nil, errors.New("frame larger than payload size")
+		}
+		_, err := io.ReadFull(conn, buf[:n])
+		return buf[:n], err
+	}
+	return recv, func() { conn.Close() }, nil
+}
+
+func parseInts(s string, min int) ([]int, error) {
+	var list []int
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || v < min {
+			return nil, fmt.Errorf("invalid value %q, want a number >= %d", f, min)
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func formatRate(rate int) string {
+	if rate == 0 {
+		return "max"
+	}
+	return strconv.Itoa(rate)
+}
+
+// us formats nanoseconds as microseconds.
+func us(v uint64) string {
+	return fmt.Sprintf("%.1fµs", float64(v)/1e3)
+}
@@ -0,0 +1,69 @@
+package main
+
+import "math/bits"
+
+// subBucketBits sets the precision of hdrHistogram: every power of two range is
+// split into 2^subBucketBits linear buckets, so values are kept within 1/128.
+const subBucketBits = 7
+
+// hdrHistogram is a log-linear histogram in the style of HdrHistogram,
+// precise enough for tail percentiles without keeping every sample.
+type hdrHistogram struct {
+	Counts []uint64 `json:"counts"`
+	Total  uint64   `json:"total"`
+	Max    uint64   `json:"max"`
+}
+
+func newHdrHistogram() *hdrHistogram {
+	return &hdrHistogram{Counts: make([]uint64, (64-subBucketBits+1)<<subBucketBits)}
+}
+
+func bucketOf(v uint64) int {
+	exp := bits.Len64(v) - subBucketBits - 1
+	if exp < 0 {
+		return int(v)
+	}
+	// keep the top subBucketBits+1 bits, the leading one selects the half
+	return (exp+1)<<subBucketBits + int(v>>uint(exp)) - 1<<subBucketBits
+}
+
+// bucketValue returns the largest value falling into bucket i.
+func bucketValue(i int) uint64 {
+	if i < 1<<(subBucketBits+1) {
+		return uint64(i)
+	}
+	exp := i>>subBucketBits - 1
+	sub := uint64(i&(1<<subBucketBits-1)) + 1<<subBucketBits
+	return (sub+1)<<uint(exp) - 1
+}
+
+func (h *hdrHistogram) record(v uint64) {
+	h.Counts[bucketOf(v)]++
+	h.Total++
+	if v > h.Max {
+		h.Max = v
+	}
+}
+
+// quantile returns the value below which q of the samples fall, q in [0, 1].
+func (h *hdrHistogram) quantile(q float64) uint64 {
+	if h.Total == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(h.Total) + 0.5)
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, c := range h.Counts {
+		seen += c
+		if seen >= rank {
+			if v := bucketValue(i); v < h.Max {
+				return v
+			}
+			return h.Max
+		}
+	}
+	return h.Max
+}
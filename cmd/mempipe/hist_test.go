@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBucketOf(t *testing.T) {
+	tests := []struct {
+		v      uint64
+		bucket int
+		max    uint64 // largest value of the bucket
+	}{
+		{0, 0, 0},
+		{1, 1, 1},
+		{127, 127, 127},
+		{128, 128, 128},
+		{255, 255, 255},
+		{256, 256, 257},
+		{257, 256, 257},
+		{258, 257, 259},
+		{1000, 506, 1003},
+		{1 << 63, 57 << subBucketBits, 1<<63 + 1<<56 - 1},
+		{math.MaxUint64, (64-subBucketBits+1)<<subBucketBits - 1, math.MaxUint64},
+	}
+	for _, tt := range tests {
+		if got := bucketOf(tt.v); got != tt.bucket {
+			t.Errorf("bucketOf(%v) = %v, want %v", tt.v, got, tt.bucket)
+		}
+		if got := bucketValue(tt.bucket); got != tt.max {
+			t.Errorf("bucketValue(%v) = %v, want %v", tt.bucket, got, tt.max)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	linear := newHdrHistogram()
+	for v := uint64(1); v <= 100; v++ {
+		linear.record(v)
+	}
+	spread := newHdrHistogram()
+	spread.record(1000)
+	spread.record(2000)
+
+	tests := []struct {
+		name string
+		h    *hdrHistogram
+		q    float64
+		want uint64
+	}{
+		{"empty", newHdrHistogram(), 0.5, 0},
+		{"min", linear, 0, 1},
+		{"median", linear, 0.5, 50},
+		{"p99", linear, 0.99, 99},
+		{"max", linear, 1, 100},
+		// the upper end of the bucket, 1000 is kept within 1/128
+		{"bucket", spread, 0.5, 1003},
+		// never above the largest sample
+		{"capped", spread, 1, 2000},
+	}
+	for _, tt := range tests {
+		if got := tt.h.quantile(tt.q); got != tt.want {
+			t.Errorf("%s: quantile(%v) = %v, want %v", tt.name, tt.q, got, tt.want)
+		}
+	}
+}
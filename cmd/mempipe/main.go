@@ -0,0 +1,277 @@
+// Command mempipe inspects and cleans up the shared memory segments used by pipes.
+//
+//	mempipe ls                            list mempipe segments
+//	mempipe stat [-id] <key>              decode the header of a segment
+//	mempipe tail [-id] [-n bytes] <key>   print frames as they are published
+//	mempipe rm [-f] <key>                 remove a segment, -f even if something is attached
+//	mempipe gc [-n] [-age d]              remove stale segments, -n only lists them
+//	mempipe bench [-compare] [flags]      measure latency and throughput, see mempipe bench -h
+//
+// Segments a reader attached to are marked for removal and listed under key 0,
+// -id looks them up by the shmid shown by ls instead.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	core "github.com/Exca-DK/go-mempipe/core"
+)
+
+var commands = map[string]func(args []string) error{
+	"ls":    ls,
+	"stat":  stat,
+	"tail":  tail,
+	"bench": bench,
+	"rm":    rm,
+	"gc":    gc,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+
+	if err := cmd(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "mempipe %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: mempipe ls | stat [-id] <key> | tail [-id] [-n bytes] <key> | rm [-f] <key> | gc [-n] [-age d] | bench [-compare] [-sizes list] [-rates list] [-n msgs]")
+	os.Exit(2)
+}
+
+func ls(args []string) error {
+	segments, err := core.Segments()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSHMID\tSIZE\tNATTCH\tCPID\tSTATE")
+	for _, s := range segments {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\n", formatKey(s.Key), s.ID, s.Size, s.Attaches, s.CreatorPID, state(s))
+	}
+	return w.Flush()
+}
+
+func stat(args []string) error {
+	fs := flag.NewFlagSet("stat", flag.ExitOnError)
+	byID := fs.Bool("id", false, "the argument is a shmid")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	s, err := lookup(fs.Arg(0), *byID)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "key:\t%s\n", formatKey(s.Key))
+	if s.Removed() {
+		fmt.Fprintf(w, "created as:\t%s\n", formatKey(s.PipeKey))
+	}
+	fmt.Fprintf(w, "shmid:\t%d\n", s.ID)
+	fmt.Fprintf(w, "size:\t%d\n", s.Size)
+	fmt.Fprintf(w, "state:\t%s\n", state(s))
+	fmt.Fprintf(w, "protocol:\tversion %d, features %#x\n", s.Version, s.Features)
+	fmt.Fprintf(w, "attached:\t%d, %d readers\n", s.Attaches, s.Readers)
+	fmt.Fprintf(w, "creator pid:\t%d\n", s.CreatorPID)
+	fmt.Fprintf(w, "last user pid:\t%d\n", s.LastUserPID)
+	fmt.Fprintf(w, "last attach:\t%s\n", formatTime(s.LastAttach))
+	fmt.Fprintf(w, "last detach:\t%s\n", formatTime(s.LastDetach))
+	fmt.Fprintf(w, "writer pid:\t%d, epoch %d\n", s.WriterPID, s.Epoch)
+	fmt.Fprintf(w, "writer closed:\t%v\n", s.Closed)
+	fmt.Fprintf(w, "heartbeat:\t%s\n", formatAge(s.Heartbeat))
+	fmt.Fprintf(w, "send counter:\t%d\n", s.SendCounter)
+	fmt.Fprintf(w, "recv counter:\t%d\n", s.RecvCounter)
+	fmt.Fprintf(w, "frame:\tseq %d, code %d, %d bytes, flags %#02x\n", s.Seq, s.Code, s.FrameSize, s.FrameFlags)
+	return w.Flush()
+}
+
+func tail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	byID := fs.Bool("id", false, "the argument is a shmid")
+	n := fs.Int("n", 64, "payload bytes to preview")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	s, err := lookup(fs.Arg(0), *byID)
+	if err != nil {
+		return err
+	}
+
+	tap, err := core.NewTap(s)
+	if err != nil {
+		return err
+	}
+	defer tap.Close()
+	tap.SetReadDeadline(100 * time.Millisecond)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	for {
+		select {
+		case <-interrupt:
+			fmt.Fprintf(os.Stderr, "missed %d frames\n", tap.Missed())
+			return nil
+		default:
+		}
+
+		msg, err := tap.ReadMsg()
+		if errors.Is(err, core.ErrReadTimedout) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s seq=%d code=%d size=%d", time.Now().Format("15:04:05.000000"), msg.Seq, msg.Code, len(msg.Payload))
+		if msg.Topic != "" {
+			fmt.Printf(" topic=%s", msg.Topic)
+		}
+		for k, v := range msg.Header {
+			fmt.Printf(" %s=%q", k, v)
+		}
+		fmt.Printf(" %s\n", preview(msg.Payload, *n))
+	}
+}
+
+// preview renders JSON compacted, text quoted and anything else as hex, cut to n bytes.
+func preview(payload []byte, n int) string {
+	var b bytes.Buffer
+	switch {
+	case json.Valid(payload) && json.Compact(&b, payload) == nil:
+	case utf8.Valid(payload):
+		b.WriteString(strconv.Quote(string(payload)))
+	default:
+		b.WriteString(hex.EncodeToString(payload))
+		n *= 2
+	}
+
+	if b.Len() > n {
+		return string(b.Bytes()[:n]) + "..."
+	}
+	return b.String()
+}
+
+func rm(args []string) error {
+	fs := flag.NewFlagSet("rm", flag.ExitOnError)
+	force := fs.Bool("f", false, "remove even if processes are attached")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	key, err := parseKey(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	s, err := core.StatSegment(key)
+	if err != nil {
+		return err
+	}
+	if s.Attaches > 0 && !*force {
+		return fmt.Errorf("%s has %d attached processes, use -f to remove it anyway", formatKey(key), s.Attaches)
+	}
+	return core.RemoveSegment(key)
+}
+
+func gc(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dry := fs.Bool("n", false, "only list the segments that would be removed")
+	age := fs.Duration("age", core.StaleAfter, "remove segments whose heartbeat is older")
+	fs.Parse(args)
+
+	var segments []core.SegmentInfo
+	var err error
+	if *dry {
+		all, lerr := core.Segments()
+		for _, s := range all {
+			if !s.Removed() && s.Stale(*age) {
+				segments = append(segments, s)
+			}
+		}
+		err = lerr
+	} else {
+		segments, err = core.CollectSegments(*age)
+	}
+
+	for _, s := range segments {
+		fmt.Printf("%s\t%d bytes, creator %d\n", formatKey(s.Key), s.Size, s.CreatorPID)
+	}
+	return err
+}
+
+func state(s core.SegmentInfo) string {
+	switch {
+	case s.Removed():
+		return "removed"
+	case s.Stale(core.StaleAfter):
+		return "stale"
+	default:
+		return "live"
+	}
+}
+
+func lookup(arg string, byID bool) (core.SegmentInfo, error) {
+	if byID {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return core.SegmentInfo{}, errors.New("invalid shmid " + strconv.Quote(arg))
+		}
+		return core.StatSegmentID(id)
+	}
+
+	key, err := parseKey(arg)
+	if err != nil {
+		return core.SegmentInfo{}, err
+	}
+	return core.StatSegment(key)
+}
+
+func parseKey(s string) (int64, error) {
+	key, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return 0, errors.New("invalid key " + strconv.Quote(s))
+	}
+	return key, nil
+}
+
+func formatKey(key int64) string {
+	return "0x" + strconv.FormatUint(uint64(uint32(key)), 16)
+}
+
+func formatAge(d time.Duration) string {
+	if d < 0 {
+		return "never"
+	}
+	return d.Round(time.Millisecond).String() + " ago"
+}
+
+func formatTime(t time.Time) string {
+	if t.Unix() == 0 {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,243 @@
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/Exca-DK/go-mempipe/core/links"
+)
+
+// A capture file starts with a header followed by one record per message:
+//
+//	header:
+//	magic "mpcp", u16 version, u16 reserved, i64 wall clock start of the recording in ns
+//	record:
+//	u32 length of the rest of the record
+//	u8  frame flags
+//	i64 ns since the start of the recording the message was read at
+//	i64 Msg.ReceivedAt
+//	i64 CLOCK_MONOTONIC ns the message was received at, so Latency survives a replay
+//	u64 Msg.Seq, u64 Msg.Missed, since version 2
+//	the frame as it is laid out in a segment: code, optional sections, payload
+//
+// All integers are big-endian.
+const (
+	captureMagic      = "mpcp"
+	captureVersion    = 2
+	captureHeaderSize = 16
+
+	// flags, offset, ReceivedAt, receivedMono
+	captureRecordHeaderSizeV1 = 1 + 8 + 8 + 8
+	// and Seq, Missed
+	captureRecordHeaderSize = captureRecordHeaderSizeV1 + 8 + 8
+)
+
+var ErrBadCapture = errors.New("not a capture file or unsupported version")
+
+// Recorder tees the messages read from a MsgReader into a capture file.
+type Recorder struct {
+	r     MsgReader
+	w     io.Writer
+	start int64 // CLOCK_MONOTONIC
+	wbuf  writeBuffer
+}
+
+// NewRecorder writes the capture header to w. Every message read through the
+// recorder is appended to w with a single Write.
+func NewRecorder(r MsgReader, w io.Writer) (*Recorder, error) {
+	var hdr [captureHeaderSize]byte
+	copy(hdr[:], captureMagic)
+	binary.BigEndian.PutUint16(hdr[4:], captureVersion)
+	binary.BigEndian.PutUint64(hdr[8:], uint64(time.Now().UnixNano()))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &Recorder{r: r, w: w, start: links.Nanotime()}, nil
+}
+
+// ReadMsg reads the next message from the underlying reader and records it.
+// The message is returned even if recording it failed.
+func (rec *Recorder) ReadMsg() (Msg, error) {
+	msg, err := rec.r.ReadMsg()
+	if err != nil {
+		return msg, err
+	}
+	return msg, rec.record(&msg)
+}
+
+func (rec *Recorder) record(msg *Msg) error {
+	f := frameFromMsg(msg)
+	f.sentAt = msg.SentAt
+	if err := checkFrame(f); err != nil {
+		return err
+	}
+
+	rec.wbuf.reset()
+	rec.wbuf.appendZero(4 + captureRecordHeaderSize)
+	flags := encodeFrameHeader(&rec.wbuf, f)
+	if msg.Dropped != 0 {
+		flags |= frameFlagReplaced
+	}
+	rec.wbuf.Write(f.payload)
+
+	b := rec.wbuf.data
+	if len(b)-4-captureRecordHeaderSize > maxUint24 {
+		return errPlainMessageTooLarge
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	b[4] = flags
+	binary.BigEndian.PutUint64(b[5:], uint64(links.Nanotime()-rec.start))
+	binary.BigEndian.PutUint64(b[13:], uint64(msg.ReceivedAt))
+	binary.BigEndian.PutUint64(b[21:], uint64(msg.receivedMono))
+	binary.BigEndian.PutUint64(b[29:], msg.Seq)
+	binary.BigEndian.PutUint64(b[37:], msg.Missed)
+
+	_, err := rec.w.Write(b)
+	return err
+}
+
+func (rec *Recorder) SetReadDeadline(t time.Duration) {
+	rec.r.SetReadDeadline(t)
+}
+
+// Replayer reads the messages of a capture file. By default messages are
+// delivered with the pacing they were recorded with, see SetSpeed.
+type Replayer struct {
+	r        io.Reader
+	version  uint16
+	started  time.Time // wall clock start of the recording
+	speed    float64
+	deadline time.Duration
+
+	origin  int64 // CLOCK_MONOTONIC the replay started at, 0 before the first read
+	rbuf    []byte
+	pending *captureRecord
+}
+
+type captureRecord struct {
+	offset int64
+	msg    Msg
+}
+
+// NewReplayer reads the capture header from r.
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	var hdr [captureHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrBadCapture
+		}
+		return nil, err
+	}
+	version := binary.BigEndian.Uint16(hdr[4:])
+	if string(hdr[:4]) != captureMagic || version < 1 || version > captureVersion {
+		return nil, ErrBadCapture
+	}
+
+	return &Replayer{
+		r:        r,
+		version:  version,
+		started:  time.Unix(0, int64(binary.BigEndian.Uint64(hdr[8:]))),
+		speed:    1,
+		deadline: -1,
+	}, nil
+}
+
+// Started returns when the recording was started.
+func (p *Replayer) Started() time.Time {
+	return p.started
+}
+
+// SetSpeed scales the recorded pacing: 1 replays in real time, 10 ten times
+// faster and 0 delivers messages as fast as possible.
+func (p *Replayer) SetSpeed(speed float64) {
+	p.speed = speed
+}
+
+// SetReadDeadline makes ReadMsg return ErrReadTimedout when the next message is not
+// due within t. The message is delivered by a later call.
+func (p *Replayer) SetReadDeadline(t time.Duration) {
+	p.deadline = t
+}
+
+// ReadMsg returns the next recorded message once it is due, or io.EOF at the end of the capture.
+// The payload is valid until the next call to ReadMsg.
+func (p *Replayer) ReadMsg() (Msg, error) {
+	if p.pending == nil {
+		rec, err := p.next()
+		if err != nil {
+			return Msg{}, err
+		}
+		p.pending = rec
+	}
+
+	now := links.Nanotime()
+	if p.origin == 0 {
+		// the first message is due right away
+		p.origin = now - p.scale(p.pending.offset)
+	}
+
+	if wait := time.Duration(p.origin + p.scale(p.pending.offset) - now); wait > 0 {
+		if p.deadline != -1 && wait > p.deadline {
+			time.Sleep(p.deadline)
+			return Msg{}, ErrReadTimedout
+		}
+		time.Sleep(wait)
+	}
+
+	msg := p.pending.msg
+	p.pending = nil
+	return msg, nil
+}
+
+func (p *Replayer) scale(offset int64) int64 {
+	if p.speed <= 0 {
+		return 0
+	}
+	return int64(float64(offset) / p.speed)
+}
+
+func (p *Replayer) next() (*captureRecord, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(p.r, size[:]); err != nil {
+		return nil, err
+	}
+
+	hdrSize := captureRecordHeaderSize
+	if p.version == 1 {
+		hdrSize = captureRecordHeaderSizeV1
+	}
+	n := int(binary.BigEndian.Uint32(size[:]))
+	// a record holds a single frame, which is at most maxUint24 bytes
+	if n < hdrSize || n > hdrSize+maxUint24 {
+		return nil, ErrBadCapture
+	}
+	if cap(p.rbuf) < n {
+		p.rbuf = make([]byte, n)
+	}
+	b := p.rbuf[:n]
+	if _, err := io.ReadFull(p.r, b); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	f, err := decodeFrame(b[hdrSize:], b[0])
+	if err != nil {
+		return nil, err
+	}
+	f.receivedAt = int64(binary.BigEndian.Uint64(b[17:]))
+	if p.version > 1 {
+		f.seq = binary.BigEndian.Uint64(b[25:])
+		f.missed = binary.BigEndian.Uint64(b[33:])
+		if b[0]&frameFlagReplaced != 0 {
+			f.dropped = f.missed
+		}
+	}
+
+	msg := msgFromFrame(&f)
+	msg.ReceivedAt = int64(binary.BigEndian.Uint64(b[9:]))
+	return &captureRecord{offset: int64(binary.BigEndian.Uint64(b[1:])), msg: msg}, nil
+}
@@ -0,0 +1,163 @@
+package conn
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// sliceReader hands out msgs, sleeping gap before each but the first.
+type sliceReader struct {
+	msgs []Msg
+	gap  time.Duration
+	read int
+}
+
+func (r *sliceReader) ReadMsg() (Msg, error) {
+	if r.read == len(r.msgs) {
+		return Msg{}, io.EOF
+	}
+	if r.read > 0 {
+		time.Sleep(r.gap)
+	}
+	r.read++
+	return r.msgs[r.read-1], nil
+}
+
+func (r *sliceReader) SetReadDeadline(time.Duration) {}
+
+func TestRecordReplay(t *testing.T) {
+	msgs := []Msg{
+		NewMessage(1, []byte("first"), 5),
+		{Code: 2, Size: 6, Topic: "ticks/AAPL", Payload: []byte("second"), Header: Header{"schema": "v2"}, SentAt: 42},
+		NewMessage(3, nil, 0),
+	}
+	msgs[1].Trace.TraceID[0], msgs[1].Trace.SpanID[0] = 1, 2
+	msgs[2].Seq, msgs[2].Missed = 7, 4
+
+	var capture bytes.Buffer
+	rec, err := NewRecorder(&sliceReader{msgs: msgs, gap: 20 * time.Millisecond}, &capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range msgs {
+		if _, err := rec.ReadMsg(); err != nil {
+			t.Fatalf("record error: %v", err)
+		}
+	}
+	if _, err := rec.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	replay := func(speed float64) time.Duration {
+		p, err := NewReplayer(bytes.NewReader(capture.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.SetSpeed(speed)
+
+		ts := time.Now()
+		for i, want := range msgs {
+			got, err := p.ReadMsg()
+			if err != nil {
+				t.Fatalf("replay error: %v", err)
+			}
+			if got.Code != want.Code || string(got.Payload) != string(want.Payload) || got.Topic != want.Topic ||
+				got.Header.Get("schema") != want.Header.Get("schema") || got.Trace != want.Trace || got.SentAt != want.SentAt ||
+				got.Seq != want.Seq || got.Missed != want.Missed {
+				t.Fatalf("diff msg %v. got: %+v, want: %+v", i, got, want)
+			}
+		}
+		if _, err := p.ReadMsg(); err != io.EOF {
+			t.Fatalf("expected EOF, got %v", err)
+		}
+		return time.Since(ts)
+	}
+
+	if d := replay(1); d < 40*time.Millisecond {
+		t.Fatalf("replayed faster than recorded: %v", d)
+	}
+	if d := replay(0); d > 20*time.Millisecond {
+		t.Fatalf("unpaced replay too slow: %v", d)
+	}
+}
+
+func TestReplayDeadline(t *testing.T) {
+	var capture bytes.Buffer
+	rec, err := NewRecorder(&sliceReader{msgs: []Msg{NewMessage(1, nil, 0), NewMessage(2, nil, 0)}, gap: 50 * time.Millisecond}, &capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.ReadMsg()
+	rec.ReadMsg()
+
+	p, err := NewReplayer(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetReadDeadline(10 * time.Millisecond)
+	if msg, err := p.ReadMsg(); err != nil || msg.Code != 1 {
+		t.Fatalf("read: code %v, err %v", msg.Code, err)
+	}
+	if _, err := p.ReadMsg(); err != ErrReadTimedout {
+		t.Fatalf("expected %v, got %v", ErrReadTimedout, err)
+	}
+
+	p.SetReadDeadline(-1)
+	if msg, err := p.ReadMsg(); err != nil || msg.Code != 2 {
+		t.Fatalf("read: code %v, err %v", msg.Code, err)
+	}
+}
+
+func TestReplayBadCapture(t *testing.T) {
+	if _, err := NewReplayer(bytes.NewReader([]byte("not a capture file"))); !errors.Is(err, ErrBadCapture) {
+		t.Fatalf("expected %v, got %v", ErrBadCapture, err)
+	}
+
+	var capture bytes.Buffer
+	if _, err := NewRecorder(&sliceReader{}, &capture); err != nil {
+		t.Fatal(err)
+	}
+	// a record claiming to be larger than any frame
+	capture.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	p, err := NewReplayer(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.ReadMsg(); !errors.Is(err, ErrBadCapture) {
+		t.Fatalf("expected %v, got %v", ErrBadCapture, err)
+	}
+}
+
+func TestRecordInvalidMsg(t *testing.T) {
+	msgs := []Msg{
+		{Code: 1, Topic: string(make([]byte, maxTopicLen+1))},
+		NewMessage(2, []byte("valid"), 5),
+	}
+	var capture bytes.Buffer
+	rec, err := NewRecorder(&sliceReader{msgs: msgs}, &capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := rec.ReadMsg(); !errors.Is(err, errTopicTooLong) || msg.Code != 1 {
+		t.Fatalf("expected msg 1 with %v, got msg %v with %v", errTopicTooLong, msg.Code, err)
+	}
+	if _, err := rec.ReadMsg(); err != nil {
+		t.Fatalf("record error: %v", err)
+	}
+
+	// only the valid message was recorded
+	p, err := NewReplayer(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetSpeed(0)
+	if msg, err := p.ReadMsg(); err != nil || msg.Code != 2 {
+		t.Fatalf("read: code %v, err %v", msg.Code, err)
+	}
+	if _, err := p.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// how often the pumps wake up from a blocking read/write to check for cancellation
+const channelPollInterval = 10 * time.Millisecond
+
+// ToChannel pumps messages from r into the returned channel until ctx is cancelled
+// or the reader fails. Payloads are copied, so messages stay valid after further reads.
+// Both channels are closed when the pump exits; the error channel yields at most one error.
+//
+// The read deadline of r is overridden so the pump can observe cancellation.
+func ToChannel(ctx context.Context, r MsgReader, buf int) (<-chan Msg, <-chan error) {
+	msgs := make(chan Msg, buf)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(msgs)
+
+		r.SetReadDeadline(channelPollInterval)
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+
+			msg, err := r.ReadMsg()
+			if errors.Is(err, ErrReadTimedout) {
+				continue
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			msg.Payload = append([]byte(nil), msg.Payload...)
+			select {
+			case msgs <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return msgs, errs
+}
+
+// FromChannel writes every message received on ch into w until ch is closed,
+// ctx is cancelled or the writer fails. The returned channel is closed when
+// the pump exits and yields at most one error.
+//
+// The write deadline of w is overridden so the pump can observe cancellation.
+func FromChannel(ctx context.Context, w MsgWriter, ch <-chan Msg) <-chan error {
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+
+		w.SetWriteDeadline(channelPollInterval)
+		for {
+			var msg Msg
+			select {
+			case m, ok := <-ch:
+				if !ok {
+					return
+				}
+				msg = m
+			case <-ctx.Done():
+				return
+			}
+
+			for {
+				err := w.WriteMsg(msg)
+				if err == nil {
+					break
+				}
+				if !errors.Is(err, ErrWriteTimedout) {
+					errs <- err
+					return
+				}
+				if ctx.Err() != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return errs
+}
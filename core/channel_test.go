@@ -0,0 +1,65 @@
+package conn
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestChannelAdapter(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	const iters = 100
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := make(chan Msg)
+	werrs := FromChannel(ctx, newMemPipe(conn1), src)
+	msgs, rerrs := ToChannel(ctx, newMemPipe(conn2), 16)
+
+	go func() {
+		for i := 0; i < iters; i++ {
+			payload := []byte(fmt.Sprintf("message %v", i))
+			src <- NewMessage(uint64(i), payload, len(payload))
+		}
+		close(src)
+	}()
+
+	for i := 0; i < iters; i++ {
+		select {
+		case msg := <-msgs:
+			want := []byte(fmt.Sprintf("message %v", i))
+			if msg.Code != uint64(i) {
+				t.Fatalf("diff code. got: %v, want: %v", msg.Code, i)
+			}
+			if !bytes.Equal(msg.Payload, want) {
+				t.Fatalf("diff msg. got: %v, want: %v", string(msg.Payload), string(want))
+			}
+		case err := <-rerrs:
+			t.Fatalf("read error: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+	}
+
+	if err := <-werrs; err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-msgs:
+		if ok {
+			t.Fatal("unexpected message after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reader pump did not exit after cancel")
+	}
+}
@@ -1,9 +1,11 @@
 package conn
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"math"
+	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/Exca-DK/go-mempipe/core/links"
@@ -13,6 +15,8 @@ import (
 var (
 	errPlainMessageTooLarge = errors.New("message too large")
 	errReadOnly             = errors.New("read only")
+	errFrameSizeMismatch    = errors.New("frame size mismatch")
+	errTopicTooLong         = errors.New("topic too long")
 )
 
 type Conn struct {
@@ -20,16 +24,61 @@ type Conn struct {
 	conn      *primitives.SharedMemMount
 	mem       *primitives.SharedMem
 	session   *sessionState
+	joined    bool   // counted among the readers in the segment header
+	joinedAt  uint32 // last frame the writer counted the readers for before joining
+
+	// writers keep the heartbeat in the segment header fresh until closed
+	stopHeartbeat chan struct{}
+	heartbeatDone chan struct{}
+
+	// writers take the eventfds of readers subscribing on the notify socket,
+	// readers stay connected to it while subscribed
+	notifyListener *net.UnixListener
+	notifyDone     chan struct{}
+	notifyConn     *net.UnixConn
 }
 
 type sessionState struct {
+	stats                       pipeStats // first for 64-bit atomic alignment
 	attached                    uint32
 	wc, rc                      uint32
+	seq                         uint64 // sequence of the last committed or read frame, doesn't wrap
+	prevSeq                     uint64 // seq before the frame being read
+	missed                      uint64 // frames skipped before the one being read
+	count                       uint64 // messages in the frame being read or last published
+	policy                      WritePolicy
+	budget                      time.Duration       // how long a lossy policy waits for acknowledgements
+	replacing                   bool                // the next frame replaces an unacknowledged one
+	dropping                    uint64              // messages lost by replacing the pending frame
+	skip                        uint64              // messages of the frame being read delivered before
+	ring                        writeBuffer         // messages of the pending frame as batch entries, see WriteRing
+	ringLen                     int                 // messages in ring
+	broadcast                   bool                // readers come and go, see Publisher
+	uncounted                   uint32              // Send Counter of a frame the writer doesn't wait for us on
+	unsynced                    bool                // seq isn't the reader's position yet, the next frame sets it
+	skipUncounted               bool                // the next frame may be uncounted, skip it if so
+	writable                    bool                // last frame was acknowledged and the slot is not reused yet
+	stamp                       bool                // carry the send time in every frame
+	checksums                   bool                // carry a CRC32C in every frame
+	notify                      *primitives.EventFD // readers park on it until the writer signals it
+	subscribers                 *notifySubscribers  // signaled by writers after publishing
+	notifyEpoch                 uint32              // epoch of the writer the reader got notify from
 	rbuf                        readBuffer
 	wbuf                        writeBuffer
+	bbuf                        writeBuffer // batch being written
+	frames                      []frame     // frames of the last slot read, handed out from next
+	next                        int
 	writeDeadline, readDeadline time.Duration
+
+	// idle, if set, is called every idleCheckInterval while waiting, an error ends the wait
+	idle     func() error
+	lastIdle int64
+	// readers, if set, returns how many readers the frame about to be written waits for
+	readers func(wc uint32) uint32
 }
 
+const idleCheckInterval = heartbeatInterval
+
 func NewReadOnlyConn(mnt *primitives.SharedMem) (*Conn, error) {
 	var session sessionState
 	session.readDeadline = -1
@@ -39,15 +88,23 @@ func NewReadOnlyConn(mnt *primitives.SharedMem) (*Conn, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := checkSegment(shm); err != nil {
+		shm.Close()
+		return nil, err
+	}
 
 	c := &Conn{
 		conn:    shm,
 		session: &session,
 		mem:     mnt,
 	}
+	if err := c.join(); err != nil {
+		shm.Close()
+		return nil, err
+	}
 
-	c.session.attached = c.getRefreshAttachC()
 	c.cantWrite = true
+	c.syncReader()
 
 	return c, nil
 }
@@ -56,6 +113,7 @@ func NewWriteOnlyConn(mnt *primitives.SharedMem) (*Conn, error) {
 	var session sessionState
 	session.readDeadline = -1
 	session.writeDeadline = -1
+	session.writable = true // nothing published yet
 
 	shm, err := mnt.Attach(&primitives.SHMAttachFlags{ReadOnly: false})
 	if err != nil {
@@ -67,14 +125,44 @@ func NewWriteOnlyConn(mnt *primitives.SharedMem) (*Conn, error) {
 		session: &session,
 		mem:     mnt,
 	}
-	c.session.attached = c.getRefreshAttachC()
+	if err := initSegment(shm); err != nil {
+		shm.Close()
+		return nil, err
+	}
+	c.session.attached = c.readers()
+	c.startHeartbeat()
 	return c, nil
 }
 
+// setKey records the IPC key in the header, readers remove it from the segment itself.
+func (c *Conn) setKey(key int64) error {
+	c.conn.Seek(offKey, 0)
+	return c.conn.AtomicWriteUint32(uint32(key))
+}
+
+func (c *Conn) startHeartbeat() {
+	c.stopHeartbeat = make(chan struct{})
+	c.heartbeatDone = make(chan struct{})
+	go func() {
+		defer close(c.heartbeatDone)
+		t := time.NewTicker(heartbeatInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-c.stopHeartbeat:
+				return
+			case <-t.C:
+				c.conn.AtomicWriteUint64At(offHeartbeat, uint64(links.Nanotime()))
+			}
+		}
+	}()
+}
+
 func NewConn(mnt *primitives.SharedMemMount) *Conn {
 	var session sessionState
 	session.readDeadline = -1
 	session.writeDeadline = -1
+	session.writable = true
 	return &Conn{
 		conn:    mnt,
 		session: &session,
@@ -84,63 +172,599 @@ func NewConn(mnt *primitives.SharedMemMount) *Conn {
 // Read reads a message from the connection.
 // The returned data buffer is valid until the next call to Read.
 func (c *Conn) Read() (uint32, []byte, int, error) {
-	if err := c.session.WaitRead(c.conn); err != nil {
+	f, err := c.readFrame()
+	if err != nil {
 		return 0, nil, 0, err
 	}
 
-	frame, err := c.session.readFrame(c.conn)
+	return f.code, f.payload, len(f.payload) + 4, nil
+}
+
+// readFunc waits for a frame and hands it to fn without copying the payload
+// out of the segment. The payload must not be retained after fn returns.
+// The messages of a batch are copied out and handed to fn one per call.
+func (c *Conn) readFunc(fn func(frame) error) error {
+	h := c.session
+	for h.next == len(h.frames) {
+		if err := h.WaitRead(c.conn); err != nil {
+			return err
+		}
+		if !h.mustCopy(c.conn) {
+			err := h.peekFrame(c.conn, fn)
+			if err == errFrameReplaced {
+				continue
+			}
+			return err
+		}
+		if err := c.readPending(); err != nil && err != errFrameReplaced {
+			return err
+		}
+	}
+	return fn(h.take(1)[0])
+}
+
+// readFrameInto waits for a frame and copies its payload into dst, which it has to fill exactly.
+func (c *Conn) readFrameInto(dst []byte) (frame, error) {
+	h := c.session
+	for h.next == len(h.frames) {
+		if err := h.WaitRead(c.conn); err != nil {
+			return frame{}, err
+		}
+		if !h.mustCopy(c.conn) {
+			f, err := h.readFrameInto(c.conn, dst)
+			if err == errFrameReplaced {
+				continue
+			}
+			return f, err
+		}
+		if err := c.readPending(); err != nil && err != errFrameReplaced {
+			return frame{}, err
+		}
+	}
+
+	f := h.take(1)[0]
+	if len(f.payload) != len(dst) {
+		return frame{}, fmt.Errorf("%w: frame has %v bytes, want %v", errFrameSizeMismatch, len(f.payload), len(dst))
+	}
+	copy(dst, f.payload)
+	f.payload = dst
+	return f, nil
+}
+
+// mustCopy reports whether the pending frame has to go through readPending instead of
+// being read in place: the messages of a batch are handed out one by one, and a writer
+// replacing frames may do so while the reader still looks at the segment.
+func (h *sessionState) mustCopy(conn *primitives.SharedMemMount) bool {
+	conn.Seek(offFeatures, 0)
+	if features, _ := conn.AtomicReadUint32(); features&featureOverwrite != 0 {
+		return true
+	}
+	conn.Seek(offSizeWord, 0)
+	word, _ := conn.AtomicReadUint32()
+	_, flags := unpackSizeWord(word)
+	return flags&frameFlagBatch != 0
+}
+
+func (c *Conn) readFrame() (frame, error) {
+	frames, err := c.readFrames(1)
 	if err != nil {
-		return 0, nil, 0, err
+		return frame{}, err
+	}
+	return frames[0], nil
+}
+
+// readFrames waits for a frame and returns up to max of the messages it holds, all of
+// them if max is 0. Messages of a batch not returned yet are returned by the next call.
+// The frames are valid until the next read.
+func (c *Conn) readFrames(max int) ([]frame, error) {
+	h := c.session
+	for h.next == len(h.frames) {
+		if err := h.WaitRead(c.conn); err != nil {
+			return nil, err
+		}
+		if err := c.readPending(); err != nil && err != errFrameReplaced {
+			return nil, err
+		}
 	}
+	return h.take(max), nil
+}
 
-	code, data := frameIntoCodeAndData(frame)
+// tryReadFrame reads the pending frame if there is one, without waiting for it.
+func (c *Conn) tryReadFrame() (frame, bool, error) {
+	h := c.session
+	if h.next == len(h.frames) {
+		if !h.canRead(c.conn) {
+			return frame{}, false, h.checkIdle()
+		}
+		err := c.readPending()
+		if err == errFrameReplaced {
+			return frame{}, false, nil
+		}
+		if err != nil {
+			return frame{}, false, err
+		}
+	}
+	return h.take(1)[0], true, nil
+}
+
+// take hands out up to max of the frames read last, all of them if max is 0.
+func (h *sessionState) take(max int) []frame {
+	end := len(h.frames)
+	if max > 0 && h.next+max < end {
+		end = h.next + max
+	}
+	frames := h.frames[h.next:end]
+	h.next = end
+	return frames
+}
+
+// readPending reads the frame canRead found into the session's frames.
+func (c *Conn) readPending() error {
+	h := c.session
+	now := links.Nanotime()
+	data, flags, err := h.readFrame(c.conn)
 	if err != nil {
-		return 0, nil, 0, fmt.Errorf("invalid message code: %v", err)
+		return err
+	}
+
+	h.frames, h.next = h.frames[:0], 0
+	if flags&frameFlagBatch != 0 {
+		h.frames, err = decodeBatch(data, h.frames)
+	} else {
+		var f frame
+		f, err = decodeFrame(data, flags)
+		h.frames = append(h.frames, f)
+	}
+	if err != nil {
+		h.frames = h.frames[:0]
+		h.stats.recordCorrupt()
+		return err
 	}
 
-	return uint32(code), data, len(data) + 4, err
+	h.numberBatch(h.frames, flags)
+	// the messages delivered before are acknowledged with the rest but not handed out
+	h.next = int(h.skip)
+	atomic.AddUint64(&h.stats.msgsRead, uint64(len(h.frames)-1-h.next))
+	for i := range h.frames {
+		f := &h.frames[i]
+		f.receivedAt = now
+		if f.sentAt != 0 {
+			h.stats.latency.observe(uint64(now - f.sentAt))
+		}
+	}
+	return nil
 }
 
-func (h *sessionState) readFrame(conn *primitives.SharedMemMount) ([]byte, error) {
+func (h *sessionState) readFrame(conn *primitives.SharedMemMount) ([]byte, byte, error) {
 	h.rbuf.reset()
-	conn.Seek(8, 0)
+	conn.Seek(offSizeWord, 0)
 
-	size, err := conn.AtomicReadUint32()
+	word, err := conn.AtomicReadUint32()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	size, flags := unpackSizeWord(word)
+	if err := h.checkSize(conn, size); err != nil {
+		return nil, 0, err
 	}
 
-	frame, err := h.rbuf.read(conn, int(size))
+	frame, err := h.rbuf.read(conn, size)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
+	if !h.holds(conn) {
+		return nil, 0, h.replaced()
+	}
+
+	h.stats.recordRead(size)
+	return frame, flags, h.ack(conn)
+}
 
-	h.rc++
-	if h.rc == math.MaxUint32 {
-		h.rc = 1
+// readFrameInto copies the payload of the pending frame straight into dst.
+// The payload must be exactly len(dst) bytes long.
+func (h *sessionState) readFrameInto(conn *primitives.SharedMemMount, dst []byte) (frame, error) {
+	h.rbuf.reset()
+	conn.Seek(offSizeWord, 0)
+
+	word, err := conn.AtomicReadUint32()
+	if err != nil {
+		return frame{}, err
 	}
-	conn.Seek(4, 0)
-	conn.AtomicWriteUint32(h.rc)
-	return frame, nil
+	size, flags := unpackSizeWord(word)
+	if err := h.checkSize(conn, size); err != nil {
+		return frame{}, err
+	}
+	if size < len(dst)+4 {
+		return frame{}, h.drop(conn, fmt.Errorf("%w: frame has %v bytes, want %v", errFrameSizeMismatch, size-4, len(dst)))
+	}
+
+	hdr, err := h.rbuf.read(conn, size-len(dst))
+	if err != nil {
+		return frame{}, err
+	}
+	f, crcAt, err := decodeSections(hdr, flags)
+	if err != nil {
+		return frame{}, h.drop(conn, err)
+	}
+	if len(f.payload) != 0 {
+		return frame{}, h.drop(conn, fmt.Errorf("%w: frame has %v bytes, want %v", errFrameSizeMismatch, len(f.payload)+len(dst), len(dst)))
+	}
+
+	if len(dst) > 0 {
+		if _, err := conn.Read(dst); err != nil {
+			return frame{}, err
+		}
+	}
+	f.payload = dst
+	if !h.holds(conn) {
+		return frame{}, h.replaced()
+	}
+	h.number(&f, flags)
+	if flags&frameFlagChecksum != 0 {
+		if err := verifyChecksum(flags, hdr[:crcAt+4], dst); err != nil {
+			return frame{}, h.drop(conn, err)
+		}
+	}
+
+	h.stats.recordRead(size)
+	return f, h.ack(conn)
+}
+
+// peekFrame hands the pending frame to fn while its payload still lives in the
+// segment and acknowledges it once fn returns, even if fn failed. Nothing checks
+// the frame stays put meanwhile, see mustCopy.
+func (h *sessionState) peekFrame(conn *primitives.SharedMemMount, fn func(frame) error) error {
+	conn.Seek(offSizeWord, 0)
+
+	word, err := conn.AtomicReadUint32()
+	if err != nil {
+		return err
+	}
+	size, flags := unpackSizeWord(word)
+	if err := h.checkSize(conn, size); err != nil {
+		return err
+	}
+
+	view, err := conn.View(size)
+	if err != nil {
+		return err
+	}
+
+	f, err := decodeFrame(view, flags)
+	if err != nil {
+		return h.drop(conn, err)
+	}
+	h.number(&f, flags)
+
+	ferr := fn(f)
+	h.stats.recordRead(size)
+	if err := h.ack(conn); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// checkSize drops the pending frame if its size word doesn't fit the segment.
+func (h *sessionState) checkSize(conn *primitives.SharedMemMount, size int) error {
+	if size < 4 || size > int(conn.Size())-offCode {
+		return h.drop(conn, fmt.Errorf("%w: size %d exceeds segment capacity", ErrCorruptFrame, size))
+	}
+	return nil
+}
+
+// drop acknowledges a frame that can't be delivered so the writer isn't stuck on it.
+// Frames that only look broken because the writer replaced them meanwhile are read again.
+func (h *sessionState) drop(conn *primitives.SharedMemMount, err error) error {
+	if !h.holds(conn) {
+		return h.replaced()
+	}
+	h.stats.recordCorrupt()
+	if aerr := h.ack(conn); aerr != nil {
+		return aerr
+	}
+	return err
+}
+
+// errFrameReplaced makes readers start over on the frame that replaced the one they were reading.
+var errFrameReplaced = errors.New("frame replaced while reading")
+
+// holds reports whether the slot still holds the frame canRead found. A writer
+// overwriting pending frames may have replaced it while it was read.
+func (h *sessionState) holds(conn *primitives.SharedMemMount) bool {
+	commit, err := conn.AtomicReadUint64At(offCommit)
+	if err != nil || commit&1 != 0 || commit != 0 && commit>>1 != h.seq {
+		return false
+	}
+	conn.Seek(offSendCounter, 0)
+	wc, err := conn.AtomicReadUint32()
+	return err == nil && wc == h.wc
+}
+
+// replaced forgets the frame that was being read, the next WaitRead finds its replacement.
+func (h *sessionState) replaced() error {
+	h.seq = h.prevSeq
+	return errFrameReplaced
+}
+
+// number sets the sequence of the frame being read.
+func (h *sessionState) number(f *frame, flags byte) {
+	f.seq, f.missed = h.seq, h.missed
+	if flags&frameFlagReplaced != 0 {
+		f.dropped = h.missed
+	}
+}
+
+// numberBatch numbers the messages of the frame being read, the first one carries
+// the messages missed before it.
+func (h *sessionState) numberBatch(frames []frame, flags byte) {
+	first := h.seq + 1 - uint64(len(frames))
+	if h.seq == 0 {
+		first = 0
+	}
+	for i := range frames {
+		frames[i].seq = first
+		if first != 0 {
+			first++
+		}
+	}
+	frames[0].missed = h.missed
+	if flags&frameFlagReplaced != 0 {
+		frames[0].dropped = h.missed
+	}
+}
+
+// slotCount returns how many messages the frame in the slot holds.
+func slotCount(conn *primitives.SharedMemMount) uint64 {
+	conn.Seek(offSizeWord, 0)
+	word, _ := conn.AtomicReadUint32()
+	if _, flags := unpackSizeWord(word); flags&frameFlagBatch == 0 {
+		return 1
+	}
+	var code [4]byte
+	if _, err := conn.Read(code[:]); err != nil || bytesToInt(code[:]) == 0 {
+		return 1
+	}
+	return uint64(bytesToInt(code[:]))
+}
+
+// ack bumps the shared Recv Counter. Every attached reader acknowledges
+// each frame once, so the writer waits for as many acks as it has readers.
+func (h *sessionState) ack(conn *primitives.SharedMemMount) error {
+	conn.Seek(offRecvCounter, 0)
+	rc, err := conn.AtomicAddUint32(1)
+	if err != nil {
+		return err
+	}
+	h.rc = rc
+	return nil
+}
+
+// maxPayload is the largest payload a frame can carry along with the sections the
+// writer adds to every frame, a topic or headers aren't accounted for.
+func (c *Conn) maxPayload() int {
+	max := int(c.conn.Size()) - offPayload
+	if max > maxUint24-4 {
+		max = maxUint24 - 4
+	}
+	h := c.session
+	if h.checksums {
+		max -= 4
+	}
+	if h.stamp {
+		max -= 8
+	}
+	if h.policy == WriteRing {
+		// the message count and size word of the batch entry
+		max -= 8
+	}
+	return max
+}
+
+// Stats returns a snapshot of the connection's counters.
+func (c *Conn) Stats() Stats {
+	s := c.session.stats.snapshot()
+	s.Role = RoleWriter
+	if c.cantWrite {
+		s.Role = RoleReader
+	} else {
+		s.Pending = c.pending()
+	}
+	return s
+}
+
+// pending reports whether the published frame still waits for acknowledgements. It is
+// worked out from the segment, Stats may be called while another goroutine writes.
+func (c *Conn) pending() uint64 {
+	if sc, _ := c.conn.AtomicReadUint32At(offSendCounter); sc == 0 {
+		return 0
+	}
+	rc, _ := c.conn.AtomicReadUint32At(offRecvCounter)
+	base, _ := c.conn.AtomicReadUint32At(offAckBase)
+	if rc-base >= c.readers() {
+		return 0
+	}
+	return 1
 }
 
 func (c *Conn) updateAttach(val uint32) {
 	c.session.attached = val
 }
 
-func (c *Conn) getRefreshAttachC() uint32 {
-	info, err := c.mem.Stat()
-	if err != nil {
-		panic(err)
+// join counts the connection among the readers of the segment until it is closed.
+// It remembers the last frame the writer counted the readers for, see countReaders.
+func (c *Conn) join() error {
+	for {
+		w, err := c.conn.AtomicReadUint64At(offReaders)
+		if err != nil {
+			return err
+		}
+		ok, err := c.conn.AtomicCompareAndSwapUint64At(offReaders, w, w+1)
+		if err != nil {
+			return err
+		}
+		if ok {
+			c.joined = true
+			c.joinedAt = uint32(w >> 32)
+			return nil
+		}
+	}
+}
+
+// leave stops counting the connection among the readers.
+func (c *Conn) leave() {
+	if !c.joined {
+		return
+	}
+	c.joined = false
+	for {
+		w, err := c.conn.AtomicReadUint64At(offReaders)
+		if err != nil || uint32(w) == 0 {
+			return
+		}
+		if ok, err := c.conn.AtomicCompareAndSwapUint64At(offReaders, w, w-1); ok || err != nil {
+			return
+		}
+	}
+}
+
+// readers returns how many readers the writer waits for. Taps and processes inspecting
+// the segment attach too, they aren't counted. Readers that died without leaving are
+// dropped once the attach count is lower than the readers counted in the header.
+func (c *Conn) readers() uint32 {
+	w, _ := c.conn.AtomicReadUint64At(offReaders)
+	return c.alive(uint32(w))
+}
+
+func (c *Conn) alive(n uint32) uint32 {
+	if c.mem == nil {
+		return n
+	}
+	if info, err := c.mem.Stat(); err == nil && info.CurrentAttaches > 0 && uint32(info.CurrentAttaches)-1 < n {
+		n = uint32(info.CurrentAttaches) - 1 // without the writer
+	}
+	return n
+}
+
+// writerGone reports whether the writer closed the segment or stopped refreshing its heartbeat.
+func (c *Conn) writerGone() bool {
+	c.conn.Seek(offClosed, 0)
+	closed, _ := c.conn.AtomicReadUint32()
+	hb, _ := c.conn.AtomicReadUint64At(offHeartbeat)
+	return closed != 0 || links.Nanotime()-int64(hb) > int64(StaleAfter)
+}
+
+// countReaders returns the readers frame wc waits for and records wc in the header, so
+// readers joining from then on know they aren't waited for before the next frame.
+func (c *Conn) countReaders(wc uint32) uint32 {
+	for {
+		w, err := c.conn.AtomicReadUint64At(offReaders)
+		if err != nil {
+			return 0
+		}
+		ok, err := c.conn.AtomicCompareAndSwapUint64At(offReaders, w, uint64(wc)<<32|uint64(uint32(w)))
+		if err != nil {
+			return 0
+		}
+		if ok {
+			return c.alive(uint32(w))
+		}
 	}
-	return uint32(info.CurrentAttaches) - 1 //dont include self
 }
 
 func (c *Conn) Write(code uint32, data []byte) (uint32, error) {
-	if len(data) > maxUint24 {
-		return 0, errPlainMessageTooLarge
+	return c.writeFrame(&frame{code: code, payload: data})
+}
+
+func (c *Conn) writeFrame(f *frame) (uint32, error) {
+	if err := c.checkWrite(f); err != nil {
+		return 0, err
+	}
+
+	if err := c.session.WaitWrite(c.conn); err != nil {
+		return 0, err
+	}
+
+	if c.session.stamp {
+		f.sentAt = links.Nanotime()
+	}
+	return c.session.writeFrame(c.conn, f)
+}
+
+// tryWriteFrame writes f if the segment is writable right away, it never waits for readers.
+func (c *Conn) tryWriteFrame(f *frame) (bool, error) {
+	if err := c.checkWrite(f); err != nil {
+		return false, err
+	}
+
+	if !c.session.tryWrite(c.conn) {
+		return false, c.session.checkIdle()
+	}
+
+	if c.session.stamp {
+		f.sentAt = links.Nanotime()
+	}
+	_, err := c.session.writeFrame(c.conn, f)
+	return err == nil, err
+}
+
+// checkWrite rejects frames that can't be written before waiting for the segment.
+func (c *Conn) checkWrite(f *frame) error {
+	if c.cantWrite {
+		return errReadOnly
+	}
+	return checkFrame(f)
+}
+
+// checkFrame rejects frames that can't be encoded.
+func checkFrame(f *frame) error {
+	if len(f.payload) > maxUint24 {
+		return errPlainMessageTooLarge
+	}
+
+	if len(f.topic) > maxTopicLen {
+		return errTopicTooLong
+	}
+
+	return validateHeader(f.header)
+}
+
+// writeBatch writes frames packed into as few frames as the segment allows, waiting
+// for the readers once per packed frame. It returns how many frames were written,
+// nothing is written if one of them doesn't fit the segment on its own.
+func (c *Conn) writeBatch(frames []frame) (int, error) {
+	max := int(c.conn.Size()) - offCode
+	if max > maxUint24 {
+		max = maxUint24
+	}
+	for i := range frames {
+		if err := c.checkWrite(&frames[i]); err != nil {
+			return 0, err
+		}
+		if c.session.batchSize(&frames[i]) > max {
+			return 0, errPlainMessageTooLarge
+		}
 	}
+	if err := addFeatures(c.conn, featureBatch); err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for written < len(frames) {
+		if err := c.session.WaitWrite(c.conn); err != nil {
+			return written, err
+		}
+		n, err := c.session.writeBatch(c.conn, frames[written:], max)
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
 
+// writeFrom waits for the segment to be writable and lets fill produce the payload of
+// the next frame in place.
+func (c *Conn) writeFrom(code uint32, fill func([]byte) (int, error)) (int, error) {
 	if c.cantWrite {
 		return 0, errReadOnly
 	}
@@ -149,8 +773,7 @@ func (c *Conn) Write(code uint32, data []byte) (uint32, error) {
 		return 0, err
 	}
 
-	wireSize := uint32(len(data)) + 4
-	return wireSize, c.session.writeFrame(c.conn, code, data)
+	return c.session.writeFrameFrom(c.conn, code, c.maxPayload(), fill)
 }
 
 var (
@@ -166,91 +789,485 @@ func (h *sessionState) SetReadDeadline(deadline time.Duration) {
 	h.readDeadline = deadline
 }
 
-func (h *sessionState) writeFrame(conn *primitives.SharedMemMount, code uint32, data []byte) error {
+func (h *sessionState) SetSendTimestamps(enabled bool) {
+	h.stamp = enabled
+}
+
+// WritePolicy decides what a writer does while the readers haven't acknowledged the last frame.
+type WritePolicy int
+
+const (
+	// WriteBlock waits for the acknowledgements, up to the write deadline.
+	WriteBlock WritePolicy = iota
+	// WriteOverwrite waits up to a budget and then replaces the pending frame, which is
+	// the oldest unread one as a segment holds a single frame. Readers learn how many
+	// messages they lost from Msg.Dropped.
+	WriteOverwrite
+	// WriteRing waits up to a budget like WriteOverwrite, but the replacing frame carries
+	// the unread messages of the pending one along with the new message. Only the oldest
+	// messages that no longer fit the segment are dropped. Batches and stream writes
+	// replace the pending frame as with WriteOverwrite.
+	WriteRing
+)
+
+// lossy reports whether the policy replaces frames the readers didn't acknowledge.
+func (h *sessionState) lossy() bool {
+	return h.policy == WriteOverwrite || h.policy == WriteRing
+}
+
+// setWritePolicy switches the write policy, budget only matters for the lossy ones.
+// Readers are told through the segment header before a frame is replaced.
+func (c *Conn) setWritePolicy(policy WritePolicy, budget time.Duration) error {
+	if c.cantWrite {
+		return errReadOnly
+	}
+	var features uint32
+	switch policy {
+	case WriteOverwrite:
+		features = featureOverwrite
+	case WriteRing:
+		features = featureOverwrite | featureBatch
+	}
+	if features != 0 {
+		if err := addFeatures(c.conn, features); err != nil {
+			return err
+		}
+	}
+	c.session.policy, c.session.budget = policy, budget
+	c.session.dropRing()
+	return nil
+}
+
+// setChecksums toggles the CRC32C section of written frames. Readers are told
+// through the segment header before the first checksummed frame is written.
+func (c *Conn) setChecksums(enabled bool) error {
+	if c.cantWrite {
+		return errReadOnly
+	}
+	if enabled {
+		if err := addFeatures(c.conn, featureChecksums); err != nil {
+			return err
+		}
+	}
+	c.session.checksums = enabled
+	return nil
+}
+
+func (h *sessionState) writeFrame(conn *primitives.SharedMemMount, f *frame) (uint32, error) {
+	if h.policy == WriteRing {
+		return h.writeRing(conn, f)
+	}
 	h.wbuf.reset()
-	conn.Seek(8, 0)
+	flags := encodeFrameHeader(&h.wbuf, f)
+	if h.replacing {
+		flags |= frameFlagReplaced
+	}
+	if h.checksums {
+		flags = appendChecksum(&h.wbuf, flags, f.payload)
+	}
+	wireSize := len(h.wbuf.data) + len(f.payload)
+	if wireSize > maxUint24 || offCode+wireSize > int(conn.Size()) {
+		// rejected before the slot is marked torn
+		return 0, errPlainMessageTooLarge
+	}
 
+	if err := h.beginWrite(conn); err != nil {
+		return 0, err
+	}
+	conn.Seek(offSizeWord, 0)
 	//signal datasize
-	conn.AtomicWriteUint32(uint32(len(data) + 4))
-	//write data
-	appendUint32(h.wbuf.appendZero(4), int(code))
-	h.wbuf.Write(data)
+	conn.AtomicWriteUint32(packSizeWord(wireSize, flags))
+	//write header, payload goes straight into the segment
 	_, err := conn.Write(h.wbuf.data)
 	if err != nil {
+		return 0, err
+	}
+	if len(f.payload) > 0 {
+		if _, err := conn.Write(f.payload); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := h.commit(conn, 1); err != nil {
+		return 0, err
+	}
+	h.stats.recordWrite(wireSize)
+	return uint32(wireSize), nil
+}
+
+// writeBatch publishes as many of frames as fit into max bytes as a single batch frame
+// and returns how many it took.
+func (h *sessionState) writeBatch(conn *primitives.SharedMemMount, frames []frame, max int) (int, error) {
+	var now int64
+	if h.stamp {
+		now = links.Nanotime()
+	}
+
+	h.bbuf.reset()
+	h.bbuf.appendZero(4) // count
+	n := 0
+	for ; n < len(frames); n++ {
+		f := &frames[n]
+		if h.stamp {
+			f.sentAt = now
+		}
+		h.wbuf.reset()
+		flags := encodeFrameHeader(&h.wbuf, f)
+		if h.checksums {
+			flags = appendChecksum(&h.wbuf, flags, f.payload)
+		}
+		if len(h.bbuf.data)+4+len(h.wbuf.data)+len(f.payload) > max {
+			break
+		}
+		appendBatchFrame(&h.bbuf, flags, h.wbuf.data, f.payload)
+	}
+	if n == 0 {
+		return 0, errPlainMessageTooLarge
+	}
+	appendUint32(h.bbuf.data, n)
+
+	var flags byte = frameFlagBatch
+	if h.replacing {
+		flags |= frameFlagReplaced
+	}
+	if err := h.beginWrite(conn); err != nil {
+		return 0, err
+	}
+	conn.Seek(offSizeWord, 0)
+	//signal datasize
+	conn.AtomicWriteUint32(packSizeWord(len(h.bbuf.data), flags))
+	if _, err := conn.Write(h.bbuf.data); err != nil {
+		return 0, err
+	}
+
+	if err := h.commit(conn, uint64(n)); err != nil {
+		return 0, err
+	}
+	h.dropRing()
+	h.stats.recordWrite(len(h.bbuf.data))
+	atomic.AddUint64(&h.stats.msgsWritten, uint64(n-1))
+	return n, nil
+}
+
+// writeRing publishes f as a batch frame along with the messages of the pending frame
+// it replaces, dropping the oldest of them that no longer fit.
+func (h *sessionState) writeRing(conn *primitives.SharedMemMount, f *frame) (uint32, error) {
+	if !h.replacing {
+		// the readers have every message of the ring
+		h.dropRing()
+	}
+	max := int(conn.Size()) - offCode
+	if max > maxUint24 {
+		max = maxUint24
+	}
+
+	h.wbuf.reset()
+	flags := encodeFrameHeader(&h.wbuf, f)
+	if h.checksums {
+		flags = appendChecksum(&h.wbuf, flags, f.payload)
+	}
+	if 4+4+len(h.wbuf.data)+len(f.payload) > max {
+		return 0, errPlainMessageTooLarge
+	}
+	appendBatchFrame(&h.ring, flags, h.wbuf.data, f.payload)
+	h.ringLen++
+
+	// evict the oldest messages until the ring and its count fit the slot
+	h.dropping = 0
+	for 4+len(h.ring.data) > max {
+		size, _ := unpackSizeWord(binary.BigEndian.Uint32(h.ring.data))
+		h.ring.data = append(h.ring.data[:0], h.ring.data[4+size:]...)
+		h.ringLen--
+		h.dropping++
+	}
+
+	flags = frameFlagBatch
+	if h.replacing {
+		flags |= frameFlagReplaced
+	}
+	size := 4 + len(h.ring.data)
+	if err := h.beginWrite(conn); err != nil {
+		return 0, err
+	}
+	conn.Seek(offSizeWord, 0)
+	//signal datasize
+	conn.AtomicWriteUint32(packSizeWord(size, flags))
+	var count [4]byte
+	appendUint32(count[:], h.ringLen)
+	if _, err := conn.Write(count[:]); err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(h.ring.data); err != nil {
+		return 0, err
+	}
+
+	if err := h.commit(conn, 1); err != nil {
+		return 0, err
+	}
+	h.count = uint64(h.ringLen)
+	h.stats.recordWrite(size)
+	return uint32(size), nil
+}
+
+// dropRing forgets the messages of the pending frame, the next frame is not built on them.
+func (h *sessionState) dropRing() {
+	h.ring.reset()
+	h.ringLen = 0
+}
+
+// batchSize returns the bytes f takes in a batch frame holding only f.
+func (h *sessionState) batchSize(f *frame) int {
+	h.wbuf.reset()
+	encodeFrameHeader(&h.wbuf, f)
+	n := 4 + 4 + len(h.wbuf.data) + len(f.payload) // count, size word
+	if h.checksums {
+		n += 4
+	}
+	if h.stamp && f.sentAt == 0 {
+		n += 8
+	}
+	return n
+}
+
+// writeFrameFrom lets fill place up to max payload bytes straight into the segment
+// and publishes them as a single frame. Nothing is published if fill produced no data.
+func (h *sessionState) writeFrameFrom(conn *primitives.SharedMemMount, code uint32, max int, fill func([]byte) (int, error)) (int, error) {
+	if err := h.beginWrite(conn); err != nil {
+		return 0, err
+	}
+	// the checksum precedes the payload
+	var sections int
+	if h.checksums {
+		sections = 4
+	}
+	conn.Seek(offPayload+int64(sections), 0)
+	dst, err := conn.View(max)
+	if err != nil && len(dst) == 0 {
+		return 0, err
+	}
+
+	n, ferr := fill(dst)
+	if n == 0 {
+		return 0, ferr
+	}
+
+	var flags byte
+	if h.replacing {
+		flags |= frameFlagReplaced
+	}
+	var hdr [8]byte
+	appendUint32(hdr[:], int(code))
+	if h.checksums {
+		flags |= frameFlagChecksum
+		binary.BigEndian.PutUint32(hdr[4:], frameChecksum(flags, hdr[:4], dst[:n]))
+	}
+
+	size := 4 + sections + n
+	conn.Seek(offSizeWord, 0)
+	//signal datasize
+	conn.AtomicWriteUint32(packSizeWord(size, flags))
+	if _, err := conn.Write(hdr[:4+sections]); err != nil {
+		return 0, err
+	}
+
+	if err := h.commit(conn, 1); err != nil {
+		return 0, err
+	}
+	h.dropRing()
+	h.stats.recordWrite(size)
+	return n, ferr
+}
+
+// beginWrite marks the slot as being written, so a writer resuming after a crash
+// discards the frame, and tells taps the slot no longer holds the last published frame.
+func (h *sessionState) beginWrite(conn *primitives.SharedMemMount) error {
+	if h.readers != nil {
+		h.attached = h.readers(h.wc + 1)
+	}
+	if err := conn.AtomicWriteUint64At(offCommit, (h.seq+1)<<1|1); err != nil {
+		return err
+	}
+	conn.Seek(offAckBase, 0)
+	if err := conn.AtomicWriteUint32(h.rc); err != nil {
 		return err
 	}
+	conn.Seek(offSlotSeq, 0)
+	return conn.AtomicWriteUint32(h.wc + 1)
+}
+
+// commit marks the written frame of n messages complete and publishes it by bumping the Send Counter.
+// Readers only look at the slot once the Send Counter moved, half written frames are never exposed.
+func (h *sessionState) commit(conn *primitives.SharedMemMount, n uint64) error {
+	h.seq += n
+	h.count = n
+	if err := conn.AtomicWriteUint64At(offCommit, h.seq<<1); err != nil {
+		return err
+	}
+	return h.publish(conn)
+}
 
-	//update the counter
-	conn.Seek(0, 0)
+// publish hands the complete frame in the slot to the readers.
+func (h *sessionState) publish(conn *primitives.SharedMemMount) error {
+	if h.replacing {
+		h.replacing = false
+		atomic.AddUint64(&h.stats.overwritten, h.dropping)
+	}
+	h.writable = false
+	// the counters wrap, only equality is ever checked on them
 	h.wc++
-	if h.rc == math.MaxUint32 {
-		h.wc = 1
+	conn.Seek(offSlotSeq, 0)
+	if err := conn.AtomicWriteUint32(h.wc); err != nil {
+		return err
+	}
+	conn.Seek(offSendCounter, 0)
+	if err := conn.AtomicWriteUint32(h.wc); err != nil {
+		return err
 	}
-	return conn.AtomicWriteUint32(h.wc)
+	if h.subscribers != nil {
+		h.subscribers.signal(&h.stats)
+	}
+	return nil
 }
 
 // Close closes the underlying network connection.
+// Writers mark the segment closed first so it can be reclaimed once everyone detached.
 func (c *Conn) Close() error {
+	if c.stopHeartbeat != nil {
+		close(c.stopHeartbeat)
+		<-c.heartbeatDone
+		c.stopHeartbeat = nil
+
+		c.conn.Seek(offClosed, 0)
+		c.conn.AtomicWriteUint32(1)
+		c.conn.Seek(offWriterPID, 0)
+		c.conn.AtomicWriteUint32(0)
+	}
+	c.leave()
+	c.closeNotify()
 	return c.conn.Close()
 }
 
 func (h *sessionState) WaitWrite(conn *primitives.SharedMemMount) error {
-	if (h.wc + h.rc) == 0 {
+	if h.writable {
 		return nil
 	}
 
 	ts := time.Now()
-	i := 1
+	i, spins := 1, 0
 	for {
 		i++
 		if !h.canWrite(conn) {
-			if i%10000 == 0 && h.writeDeadline != -1 {
+			if h.lossy() && (h.budget == 0 || i%100 == 0) && time.Since(ts) >= h.budget {
+				// the readers fell behind, replace the pending frame
+				h.replace()
+				break
+			}
+			if i%10000 == 0 {
 				i = 1
-				if time.Since(ts) > h.writeDeadline {
+				if h.writeDeadline != -1 && time.Since(ts) > h.writeDeadline {
+					h.stats.recordWait(&h.stats.writeWait, ts, spins)
+					atomic.AddUint64(&h.stats.writeTimeouts, 1)
 					return ErrWriteTimedout
 				}
+				if err := h.checkIdle(); err != nil {
+					h.stats.recordWait(&h.stats.writeWait, ts, spins)
+					return err
+				}
 			}
 		} else {
 			break
 		}
 
+		spins++
 		links.Wait()
 	}
 
+	h.stats.recordWait(&h.stats.writeWait, ts, spins)
+	h.writable = true
 	return nil
 }
 
+// tryWrite checks once whether the next frame can be written. A lossy policy only
+// replaces the pending frame here if its budget is 0, there is no wait to measure it against.
+func (h *sessionState) tryWrite(conn *primitives.SharedMemMount) bool {
+	if h.writable {
+		return true
+	}
+	if !h.canWrite(conn) {
+		if !h.lossy() || h.budget != 0 {
+			return false
+		}
+		h.replace()
+	}
+	h.writable = true
+	return true
+}
+
+// replace makes the next frame replace the pending one. Unless the ring keeps them,
+// its messages are lost.
+func (h *sessionState) replace() {
+	h.replacing = true
+	h.dropping = h.count
+}
+
 func (h *sessionState) WaitRead(conn *primitives.SharedMemMount) error {
 	ts := time.Now()
-	i := 1
+	i, spins := 1, 0
 	for {
 		i++
 		if !h.canRead(conn) {
-			if i%1000 == 0 && h.readDeadline != -1 {
+			if i%1000 == 0 {
 				i = 1
-				if time.Since(ts) > h.readDeadline {
+				if h.readDeadline != -1 && time.Since(ts) > h.readDeadline {
+					h.stats.recordWait(&h.stats.readWait, ts, spins)
+					atomic.AddUint64(&h.stats.readTimeouts, 1)
 					return ErrReadTimedout
 				}
+				if err := h.checkIdle(); err != nil {
+					h.stats.recordWait(&h.stats.readWait, ts, spins)
+					return err
+				}
+				if h.notify != nil {
+					if err := h.park(conn, ts); err != nil {
+						h.stats.recordWait(&h.stats.readWait, ts, spins)
+						return err
+					}
+				}
 			}
 		} else {
 			break
 		}
+		spins++
 		links.Wait()
 	}
+	h.stats.recordWait(&h.stats.readWait, ts, spins)
 	return nil
 }
 
+// checkIdle runs the idle hook if it hasn't run for idleCheckInterval.
+func (h *sessionState) checkIdle() error {
+	if h.idle == nil {
+		return nil
+	}
+	now := links.Nanotime()
+	if now-h.lastIdle < int64(idleCheckInterval) {
+		return nil
+	}
+	h.lastIdle = now
+	return h.idle()
+}
+
 func (h *sessionState) canWrite(conn *primitives.SharedMemMount) bool {
-	conn.Seek(4, 0)
+	if h.broadcast && h.attached == 0 {
+		// nobody to wait for
+		return true
+	}
+	conn.Seek(offRecvCounter, 0)
 	c, err := conn.AtomicReadUint32()
 	if err != nil {
 		return false
 	}
-	if c == h.rc {
-		return false
-	}
-
-	if h.rc+h.attached != c {
+	if !h.acked(c) {
 		return false
 	}
 
@@ -258,8 +1275,24 @@ func (h *sessionState) canWrite(conn *primitives.SharedMemMount) bool {
 	return true
 }
 
+// acked reports whether the Recv Counter c shows every reader acknowledged the last frame.
+func (h *sessionState) acked(c uint32) bool {
+	if c == h.rc {
+		return false
+	}
+	if h.lossy() {
+		// readers may acknowledge a frame that got replaced before they read its replacement
+		return c-h.rc >= h.attached
+	}
+	if h.broadcast {
+		// the count drops for subscribers that left, maybe after acknowledging
+		return c-h.rc >= h.attached
+	}
+	return h.rc+h.attached == c
+}
+
 func (h *sessionState) canRead(conn *primitives.SharedMemMount) bool {
-	conn.Seek(0, 0)
+	conn.Seek(offSendCounter, 0)
 	c, err := conn.AtomicReadUint32()
 	if err != nil {
 		return false
@@ -268,5 +1301,40 @@ func (h *sessionState) canRead(conn *primitives.SharedMemMount) bool {
 		return false
 	}
 	h.wc = c //update local write counter
+	if h.skipUncounted {
+		h.skipUncounted = false
+		if c == h.uncounted {
+			// published before the writer counted us, it doesn't wait for our acknowledgement
+			return false
+		}
+	}
+	// stable until acknowledged, the writer doesn't touch the slot before
+	commit, _ := conn.AtomicReadUint64At(offCommit)
+	seq := commit >> 1
+	// a batch is numbered up to seq
+	h.count = slotCount(conn)
+	first := seq - h.count + 1
+	h.missed, h.skip = 0, 0
+	h.prevSeq = h.seq
+	switch {
+	case seq == 0:
+		// the writer doesn't number its frames
+	case seq <= h.seq:
+		// delivered before, acknowledge it without handing it out again
+		atomic.AddUint64(&h.stats.duplicates, h.count)
+		h.ack(conn)
+		return false
+	case h.unsynced:
+		// gaps are counted from the first frame a subscriber gets
+		h.unsynced = false
+	case first > h.seq+1:
+		h.missed = first - h.seq - 1
+		atomic.AddUint64(&h.stats.missed, h.missed)
+	case first <= h.seq:
+		// a ring frame carries on the messages of the frame it replaced
+		h.skip = h.seq - first + 1
+		atomic.AddUint64(&h.stats.duplicates, h.skip)
+	}
+	h.seq = seq
 	return true
 }
@@ -21,6 +21,7 @@ func TestMemConn(t *testing.T) {
 	conn2 := connSetup(t, false, 4096)
 	defer conn2.Close()
 	defer conn1.Close()
+	conn2.updateAttach(conn2.readers())
 
 	const (
 		iterations = 1024 * 5
@@ -137,8 +138,8 @@ func BenchmarkMemConn(b *testing.B) {
 	conn2 := connSetup(b, false, 4096)
 	defer conn2.Close()
 	defer conn1.Close()
-	conn1.updateAttach(conn1.getRefreshAttachC())
-	conn2.updateAttach(conn2.getRefreshAttachC())
+	conn1.updateAttach(conn1.readers())
+	conn2.updateAttach(conn2.readers())
 
 	writeData := []byte("test interprocess message x1234567890")
 
@@ -187,5 +188,8 @@ func connSetup(t itest, create bool, size uint64) *Conn {
 
 	c := NewConn(mnt)
 	c.mem = mem
+	if !create {
+		c.join()
+	}
 	return c
 }
@@ -2,8 +2,74 @@ package conn
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
 )
 
+// ErrCorruptFrame is returned for frames that can't have been written by a well behaved writer.
+// The frame is acknowledged and dropped, the pipe stays usable.
+var ErrCorruptFrame = errors.New("corrupt frame")
+
+var (
+	errMalformedFrame   = fmt.Errorf("%w: malformed sections", ErrCorruptFrame)
+	errChecksumMismatch = fmt.Errorf("%w: checksum mismatch", ErrCorruptFrame)
+)
+
+// frame flags live in the top byte of the size word, the frame size in the lower 24 bits
+const (
+	frameFlagTopic = 1 << iota
+	frameFlagSentAt
+	frameFlagTrace
+	frameFlagHeader
+	// CRC32C of the flags, the frame up to the checksum and the payload; always the last section
+	frameFlagChecksum
+	// no section, the frame replaced one the readers didn't acknowledge, see WriteOverwrite
+	frameFlagReplaced
+	// no section, the code is a message count and the payload holds that many frames,
+	// each preceded by its size word; see WriteBatch
+	frameFlagBatch
+
+	// batch frames are split by decodeBatch, their frames are decoded on their own
+	knownFrameFlags = frameFlagTopic | frameFlagSentAt | frameFlagTrace | frameFlagHeader | frameFlagChecksum | frameFlagReplaced
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	maxTopicLen = 0xff
+
+	// header section: u16 section length, then per entry u8 key length, key, u16 value length, value
+	maxHeaderKeyLen     = 0xff
+	maxHeaderValueLen   = 0xffff
+	maxHeaderSectionLen = 0xffff
+)
+
+var errHeaderTooLarge = errors.New("header too large")
+
+// codes reserved for the framing of the struct and stream transports
+const (
+	structLayoutCode uint32 = math.MaxUint32 - iota
+	structDataCode
+	streamDataCode
+	streamEOFCode
+)
+
+type frame struct {
+	code    uint32
+	topic   string
+	sentAt  int64 // CLOCK_MONOTONIC nanoseconds, 0 if not stamped
+	trace   SpanContext
+	header  Header
+	payload []byte
+
+	receivedAt int64 // CLOCK_MONOTONIC nanoseconds, local to the reader
+	seq        uint64
+	missed     uint64
+	dropped    uint64
+}
+
 func appendUint32(buff []byte, v int) {
 	binary.BigEndian.PutUint32(buff, uint32(v))
 }
@@ -17,3 +83,210 @@ func frameIntoCodeAndData(b []byte) (int, []byte) {
 	size := bytesToInt(b)
 	return int(size), b[4:]
 }
+
+func packSizeWord(size int, flags byte) uint32 {
+	return uint32(flags)<<24 | uint32(size)
+}
+
+func unpackSizeWord(v uint32) (int, byte) {
+	return int(v & uint32(maxUint24)), byte(v >> 24)
+}
+
+// encodeFrameHeader writes everything preceding the payload and returns the frame flags.
+func encodeFrameHeader(b *writeBuffer, f *frame) byte {
+	var flags byte
+	appendUint32(b.appendZero(4), int(f.code))
+	if len(f.topic) > 0 {
+		flags |= frameFlagTopic
+		b.appendZero(1)[0] = byte(len(f.topic))
+		b.Write([]byte(f.topic))
+	}
+	if f.sentAt != 0 {
+		flags |= frameFlagSentAt
+		binary.BigEndian.PutUint64(b.appendZero(8), uint64(f.sentAt))
+	}
+	if f.trace.IsValid() {
+		flags |= frameFlagTrace
+		b.Write(f.trace.TraceID[:])
+		b.Write(f.trace.SpanID[:])
+		b.appendZero(1)[0] = f.trace.Flags
+	}
+	if len(f.header) > 0 {
+		flags |= frameFlagHeader
+		binary.BigEndian.PutUint16(b.appendZero(2), uint16(headerSectionLen(f.header)))
+		for k, v := range f.header {
+			b.appendZero(1)[0] = byte(len(k))
+			b.Write([]byte(k))
+			binary.BigEndian.PutUint16(b.appendZero(2), uint16(len(v)))
+			b.Write([]byte(v))
+		}
+	}
+	return flags
+}
+
+// appendChecksum adds the checksum section to a frame encoded by encodeFrameHeader
+// and returns the updated flags.
+func appendChecksum(b *writeBuffer, flags byte, payload []byte) byte {
+	flags |= frameFlagChecksum
+	sum := frameChecksum(flags, b.data, payload)
+	binary.BigEndian.PutUint32(b.appendZero(4), sum)
+	return flags
+}
+
+func frameChecksum(flags byte, sections, payload []byte) uint32 {
+	sum := crc32.Update(0, castagnoli, []byte{flags})
+	sum = crc32.Update(sum, castagnoli, sections)
+	return crc32.Update(sum, castagnoli, payload)
+}
+
+func headerSectionLen(h Header) int {
+	n := 0
+	for k, v := range h {
+		n += 1 + len(k) + 2 + len(v)
+	}
+	return n
+}
+
+func validateHeader(h Header) error {
+	for k, v := range h {
+		if len(k) > maxHeaderKeyLen || len(v) > maxHeaderValueLen {
+			return errHeaderTooLarge
+		}
+	}
+	if headerSectionLen(h) > maxHeaderSectionLen {
+		return errHeaderTooLarge
+	}
+	return nil
+}
+
+func decodeHeader(b []byte) (Header, error) {
+	h := make(Header)
+	for len(b) > 0 {
+		klen := int(b[0])
+		if len(b) < 1+klen+2 {
+			return nil, errMalformedFrame
+		}
+		k := string(b[1 : 1+klen])
+		b = b[1+klen:]
+
+		vlen := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+vlen {
+			return nil, errMalformedFrame
+		}
+		h[k] = string(b[2 : 2+vlen])
+		b = b[2+vlen:]
+	}
+	return h, nil
+}
+
+// decodeFrame decodes a whole frame and verifies its checksum if it carries one.
+func decodeFrame(b []byte, flags byte) (frame, error) {
+	f, n, err := decodeSections(b, flags)
+	if err != nil {
+		return f, err
+	}
+	if flags&frameFlagChecksum != 0 {
+		return f, verifyChecksum(flags, b[:n+4], f.payload)
+	}
+	return f, nil
+}
+
+// appendBatchFrame adds a frame encoded by encodeFrameHeader, its flags and payload to a batch.
+func appendBatchFrame(b *writeBuffer, flags byte, sections, payload []byte) {
+	binary.BigEndian.PutUint32(b.appendZero(4), packSizeWord(len(sections)+len(payload), flags))
+	b.Write(sections)
+	b.Write(payload)
+}
+
+// decodeBatch decodes the frames of a batch frame and appends them to frames.
+func decodeBatch(b []byte, frames []frame) ([]frame, error) {
+	if len(b) < 4 {
+		return frames, errMalformedFrame
+	}
+	count, b := frameIntoCodeAndData(b)
+	for i := 0; i < count; i++ {
+		if len(b) < 4 {
+			return frames, errMalformedFrame
+		}
+		size, flags := unpackSizeWord(binary.BigEndian.Uint32(b))
+		if len(b) < 4+size {
+			return frames, errMalformedFrame
+		}
+		f, err := decodeFrame(b[4:4+size], flags)
+		if err != nil {
+			return frames, err
+		}
+		frames, b = append(frames, f), b[4+size:]
+	}
+	if count == 0 || len(b) != 0 {
+		return frames, errMalformedFrame
+	}
+	return frames, nil
+}
+
+// verifyChecksum checks the checksum at the end of sections against the frame.
+func verifyChecksum(flags byte, sections, payload []byte) error {
+	n := len(sections) - 4
+	if frameChecksum(flags, sections[:n], payload) != binary.BigEndian.Uint32(sections[n:]) {
+		return errChecksumMismatch
+	}
+	return nil
+}
+
+// decodeSections decodes everything preceding the payload, the rest of b becomes the payload.
+// It returns where the checksum section starts, if the frame has one.
+func decodeSections(b []byte, flags byte) (frame, int, error) {
+	var f frame
+	if len(b) < 4 || flags&^knownFrameFlags != 0 {
+		return f, 0, errMalformedFrame
+	}
+	all := b
+	code, b := frameIntoCodeAndData(b)
+	f.code = uint32(code)
+
+	if flags&frameFlagTopic != 0 {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return f, 0, errMalformedFrame
+		}
+		f.topic, b = string(b[1:1+int(b[0])]), b[1+int(b[0]):]
+	}
+
+	if flags&frameFlagSentAt != 0 {
+		if len(b) < 8 {
+			return f, 0, errMalformedFrame
+		}
+		f.sentAt, b = int64(binary.BigEndian.Uint64(b)), b[8:]
+	}
+
+	if flags&frameFlagTrace != 0 {
+		if len(b) < traceLen {
+			return f, 0, errMalformedFrame
+		}
+		copy(f.trace.TraceID[:], b[:16])
+		copy(f.trace.SpanID[:], b[16:24])
+		f.trace.Flags, b = b[24], b[traceLen:]
+	}
+
+	if flags&frameFlagHeader != 0 {
+		if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+			return f, 0, errMalformedFrame
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		header, err := decodeHeader(b[2 : 2+n])
+		if err != nil {
+			return f, 0, err
+		}
+		f.header, b = header, b[2+n:]
+	}
+
+	var at int
+	if flags&frameFlagChecksum != 0 {
+		if len(b) < 4 {
+			return f, 0, errMalformedFrame
+		}
+		at, b = len(all)-len(b), b[4:]
+	}
+
+	f.payload = b
+	return f, at, nil
+}
@@ -0,0 +1,188 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Exca-DK/go-mempipe/core/links"
+	"github.com/Exca-DK/go-mempipe/core/primitives"
+)
+
+// Every segment starts with a header identifying it as a mempipe segment,
+// followed by the frame slot. The header takes whole cache lines so the
+// counters polled by both sides don't share one with it.
+//
+//	header:
+//	offset  0: magic
+//	offset  4: slot sequence, the Send Counter value of the frame in the slot
+//	offset  8: heartbeat, CLOCK_MONOTONIC ns the writer was last known alive at
+//	offset 16: closed, set once the writer closed the pipe
+//	offset 20: protocol version
+//	offset 24: byte order mark, 0x01020304 in the creator's byte order
+//	offset 28: feature bits, see feature*
+//	offset 32: capacity, size of the segment in bytes
+//	offset 40: commit word, sequence of the frame in the slot << 1 | 1 while it is being written
+//	offset 48: pid of the writer owning the segment, 0 once it closed
+//	offset 52: ack base, Recv Counter value the frame in the slot was published at
+//	offset 56: IPC key the segment was created with, kept after readers remove the key
+//	offset 60: epoch, bumped by every writer taking over the pipe
+//	offset 64: readers, number of readers attached, kept up by the readers themselves,
+//	           and above it the Send Counter value of the last frame the writer counted them for
+//	frame slot:
+//	offset 128: Send Counter
+//	offset 132: Recv Counter
+//	offset 136: size word
+//	offset 140: code
+//	offset 144: optional sections and payload
+const (
+	segmentHeaderSize = 128
+
+	offMagic     = 0
+	offSlotSeq   = 4
+	offHeartbeat = 8
+	offClosed    = 16
+	offVersion   = 20
+	offByteOrder = 24
+	offFeatures  = 28
+	offCapacity  = 32
+	offCommit    = 40
+	offWriterPID = 48
+	offAckBase   = 52
+	offKey       = 56
+	offEpoch     = 60
+	offReaders   = 64
+
+	offSendCounter = segmentHeaderSize
+	offRecvCounter = segmentHeaderSize + 4
+	offSizeWord    = segmentHeaderSize + 8
+	offCode        = segmentHeaderSize + 12
+	offPayload     = segmentHeaderSize + 16
+)
+
+// segmentMagic marks segments created by a mempipe writer, "mpip".
+const segmentMagic uint32 = 0x6d706970
+
+// The protocol version changes whenever the layout does in a way older peers can't
+// cope with. Additions that are safe to ignore are announced as feature bits instead.
+const (
+	protocolVersion    = 2
+	minProtocolVersion = 2
+
+	byteOrderMark uint32 = 0x01020304
+)
+
+const (
+	// frames may carry optional sections flagged in the size word
+	featureFrameSections uint32 = 1 << iota
+	// the slot sequence is maintained for taps
+	featureSlotSeq
+	// the writer refreshes the heartbeat and marks the segment closed
+	featureHeartbeat
+	// frames may carry a CRC32C, set once the writer enables checksums
+	featureChecksums
+	// the commit word and ack base are maintained, a new writer can resume the segment
+	featureCommit
+	// the writer may replace frames before they are acknowledged, set once it does
+	featureOverwrite
+	// the writer signals the readers after publishing, they subscribe with an eventfd on its notify socket
+	featureNotify
+	// frames may pack several messages, set once the writer writes a batch
+	featureBatch
+
+	// features every segment is created with
+	baseFeatures  = featureFrameSections | featureSlotSeq | featureHeartbeat | featureCommit
+	knownFeatures = baseFeatures | featureChecksums | featureOverwrite | featureNotify | featureBatch
+)
+
+var ErrIncompatibleSegment = errors.New("incompatible segment")
+
+// how long a reader waits for the creator to stamp the header of a new segment
+const segmentInitTimeout = 100 * time.Millisecond
+
+// heartbeatInterval is how often writers refresh the heartbeat. A segment whose
+// heartbeat is older than StaleAfter lost its writer.
+const (
+	heartbeatInterval = time.Second
+	StaleAfter        = 10 * heartbeatInterval
+)
+
+// initSegment stamps the header of a freshly created segment.
+// The magic goes last, readers only trust the header once it is set.
+func initSegment(conn *primitives.SharedMemMount) error {
+	if err := conn.AtomicWriteUint64At(offHeartbeat, uint64(links.Nanotime())); err != nil {
+		return err
+	}
+	if err := conn.AtomicWriteUint64At(offCapacity, uint64(conn.Size())); err != nil {
+		return err
+	}
+	conn.Seek(offVersion, 0)
+	conn.AtomicWriteUint32(protocolVersion)
+	conn.AtomicWriteUint32(byteOrderMark)
+	conn.AtomicWriteUint32(baseFeatures)
+	conn.Seek(offWriterPID, 0)
+	conn.AtomicWriteUint32(uint32(os.Getpid()))
+	conn.Seek(offEpoch, 0)
+	conn.AtomicWriteUint32(1)
+
+	conn.Seek(offMagic, 0)
+	return conn.AtomicWriteUint32(segmentMagic)
+}
+
+// addFeatures announces features the writer started using after the segment was created.
+func addFeatures(conn *primitives.SharedMemMount, bits uint32) error {
+	for {
+		conn.Seek(offFeatures, 0)
+		features, err := conn.AtomicReadUint32()
+		if err != nil || features&bits == bits {
+			return err
+		}
+		conn.Seek(offFeatures, 0)
+		if ok, err := conn.AtomicCompareAndSwapUint32(features, features|bits); ok || err != nil {
+			return err
+		}
+	}
+}
+
+// checkSegment validates the header written by the creator against what this
+// build understands and the size the segment was opened with.
+func checkSegment(conn *primitives.SharedMemMount) error {
+	if conn.Size() < offPayload {
+		return fmt.Errorf("%w: %d bytes is too small for a pipe", ErrIncompatibleSegment, conn.Size())
+	}
+
+	var magic uint32
+	for ts := time.Now(); ; time.Sleep(time.Millisecond) {
+		conn.Seek(offMagic, 0)
+		magic, _ = conn.AtomicReadUint32()
+		if magic != 0 || time.Since(ts) > segmentInitTimeout {
+			break
+		}
+	}
+
+	conn.Seek(offByteOrder, 0)
+	if bom, _ := conn.AtomicReadUint32(); bom != byteOrderMark && magic != 0 {
+		return fmt.Errorf("%w: created with a different byte order", ErrIncompatibleSegment)
+	}
+	if magic != segmentMagic {
+		return fmt.Errorf("%w: not a mempipe segment", ErrIncompatibleSegment)
+	}
+
+	conn.Seek(offVersion, 0)
+	version, _ := conn.AtomicReadUint32()
+	if version < minProtocolVersion || version > protocolVersion {
+		return fmt.Errorf("%w: protocol version %d, supported %d to %d", ErrIncompatibleSegment, version, minProtocolVersion, protocolVersion)
+	}
+
+	conn.Seek(offFeatures, 0)
+	if features, _ := conn.AtomicReadUint32(); features&^knownFeatures != 0 {
+		return fmt.Errorf("%w: unknown features %#x", ErrIncompatibleSegment, features&^knownFeatures)
+	}
+
+	capacity, _ := conn.AtomicReadUint64At(offCapacity)
+	if capacity != uint64(conn.Size()) {
+		return fmt.Errorf("%w: segment holds %d bytes, opened with %d", ErrIncompatibleSegment, capacity, conn.Size())
+	}
+	return nil
+}
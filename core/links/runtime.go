@@ -25,3 +25,11 @@ func Wait() {
 		mcall(gosched_m)
 	}
 }
+
+//go:linkname nanotime runtime.nanotime
+func nanotime() int64
+
+// Nanotime reads CLOCK_MONOTONIC, which is shared by every process on the machine.
+func Nanotime() int64 {
+	return nanotime()
+}
@@ -1,6 +1,7 @@
 package conn
 
 import (
+	"context"
 	"fmt"
 	"time"
 )
@@ -17,14 +18,46 @@ type MsgReadWriter interface {
 type Msg struct {
 	Code       uint64
 	Size       uint32 // Size of the raw payload
+	Topic      string // Optional topic, see Publisher
 	Payload    []byte
 	ReceivedAt int64
+	SentAt     int64       // CLOCK_MONOTONIC nanoseconds, set if the writer enabled send timestamps
+	Trace      SpanContext // Optional span the message belongs to
+	Header     Header      // Optional metadata, e.g. content type or schema version
+
+	// Seq numbers the messages of a pipe from 1 without wrapping, it carries on over
+	// writer restarts. 0 if the writer doesn't maintain it.
+	Seq uint64
+	// Missed is how many messages the reader didn't get between the previous one and this one.
+	Missed uint64
+	// Dropped is set to Missed if the writer replaced the messages before the reader got them.
+	Dropped uint64
+
+	receivedMono int64
+}
+
+// Header holds small key/value metadata sent along with a message.
+// Keys are limited to 255 bytes, values and the whole encoded header to 64KiB.
+type Header map[string]string
+
+// Get returns the value of key, or "" if it is not set.
+func (h Header) Get(key string) string {
+	return h[key]
 }
 
 func (msg Msg) Time() time.Time {
 	return time.UnixMicro(msg.ReceivedAt)
 }
 
+// Latency is the time the message spent between the writer and the reader.
+// It is zero unless the writer enabled send timestamps.
+func (msg Msg) Latency() time.Duration {
+	if msg.SentAt == 0 || msg.receivedMono == 0 {
+		return 0
+	}
+	return time.Duration(msg.receivedMono - msg.SentAt)
+}
+
 func (msg *Msg) setTimestamp(t time.Time) {
 	msg.ReceivedAt = t.UnixMicro()
 }
@@ -67,3 +100,13 @@ type MsgWriter interface {
 	// if fails to send message within this window, WriteMsg will return error
 	SetWriteDeadline(t time.Duration)
 }
+
+// ContextMsgReader restores the trace context sent along with messages.
+type ContextMsgReader interface {
+	ReadMsgContext(ctx context.Context) (context.Context, Msg, error)
+}
+
+// ContextMsgWriter sends the trace context of ctx along with messages.
+type ContextMsgWriter interface {
+	WriteMsgContext(ctx context.Context, msg Msg) error
+}
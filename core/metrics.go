@@ -0,0 +1,226 @@
+package conn
+
+import (
+	"math/bits"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// histogramBuckets covers values up to 2^39, bucket i counts values in (2^(i-1), 2^i]
+// and bucket 0 counts 0 and 1.
+const histogramBuckets = 41
+
+// Histogram is a snapshot of a power of two histogram.
+type Histogram struct {
+	Count   uint64
+	Sum     uint64
+	Buckets [histogramBuckets]uint64
+}
+
+// UpperBound returns the inclusive upper bound of bucket i. The last bucket is unbounded.
+func (h Histogram) UpperBound(i int) uint64 {
+	return 1 << uint(i)
+}
+
+// Mean returns the average observed value.
+func (h Histogram) Mean() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return float64(h.Sum) / float64(h.Count)
+}
+
+type histogram struct {
+	count, sum uint64
+	buckets    [histogramBuckets]uint64
+}
+
+func (h *histogram) observe(v uint64) {
+	var i int
+	if v > 0 {
+		i = bits.Len64(v - 1)
+	}
+	if i >= histogramBuckets {
+		i = histogramBuckets - 1
+	}
+	atomic.AddUint64(&h.buckets[i], 1)
+	atomic.AddUint64(&h.sum, v)
+	atomic.AddUint64(&h.count, 1)
+}
+
+func (h *histogram) snapshot() Histogram {
+	var s Histogram
+	s.Count = atomic.LoadUint64(&h.count)
+	s.Sum = atomic.LoadUint64(&h.sum)
+	for i := range h.buckets {
+		s.Buckets[i] = atomic.LoadUint64(&h.buckets[i])
+	}
+	return s
+}
+
+// Role tells which end of a pipe the statistics were collected on.
+type Role string
+
+const (
+	RoleReader Role = "reader"
+	RoleWriter Role = "writer"
+)
+
+// Stats is a point in time snapshot of a pipe's counters.
+type Stats struct {
+	Key  int64
+	Role Role
+
+	MsgsWritten, BytesWritten uint64
+	MsgsRead, BytesRead       uint64
+
+	// time spent in every WaitWrite/WaitRead, in nanoseconds, and the spin iterations done there
+	WriteWait, ReadWait Histogram
+	Spins               uint64
+	// times a reader slept on the writer's notifications instead of spinning, see EnableNotify
+	Parks uint64
+	// notifications the writer failed to deliver to a subscribed reader
+	NotifyErrors uint64
+
+	WriteTimeouts, ReadTimeouts uint64
+
+	// frames dropped by the reader because they failed validation, see ErrCorruptFrame
+	CorruptFrames uint64
+	// gaps and repeats in the frame sequence seen by the reader, see Msg.Seq
+	MsgsMissed, Duplicates uint64
+	// messages the writer dropped by replacing frames before all readers acknowledged
+	// them, see WriteOverwrite and WriteRing
+	Overwritten uint64
+
+	// frames published by the writer and not yet acknowledged by all attached readers,
+	// read from the Send and Recv Counters of the segment
+	Pending uint64
+
+	// size of the frames on the wire, in bytes
+	FrameSizes Histogram
+
+	// time between sending and receiving, in nanoseconds, of frames carrying a send timestamp
+	Latency Histogram
+}
+
+// pipeStats are the live counters behind Stats, updated atomically.
+type pipeStats struct {
+	msgsWritten, bytesWritten uint64
+	msgsRead, bytesRead       uint64
+	spins                     uint64
+	parks                     uint64
+	notifyErrors              uint64
+	writeTimeouts             uint64
+	readTimeouts              uint64
+	corruptFrames             uint64
+	missed, duplicates        uint64
+	overwritten               uint64
+	frameSizes                histogram
+	latency                   histogram
+	writeWait, readWait       histogram
+}
+
+func (s *pipeStats) recordWrite(size int) {
+	atomic.AddUint64(&s.msgsWritten, 1)
+	atomic.AddUint64(&s.bytesWritten, uint64(size))
+	s.frameSizes.observe(uint64(size))
+}
+
+func (s *pipeStats) recordRead(size int) {
+	atomic.AddUint64(&s.msgsRead, 1)
+	atomic.AddUint64(&s.bytesRead, uint64(size))
+	s.frameSizes.observe(uint64(size))
+}
+
+func (s *pipeStats) recordCorrupt() {
+	atomic.AddUint64(&s.corruptFrames, 1)
+}
+
+func (s *pipeStats) recordWait(wait *histogram, since time.Time, spins int) {
+	wait.observe(uint64(time.Since(since)))
+	atomic.AddUint64(&s.spins, uint64(spins))
+}
+
+func (s *pipeStats) snapshot() Stats {
+	return Stats{
+		MsgsWritten:   atomic.LoadUint64(&s.msgsWritten),
+		BytesWritten:  atomic.LoadUint64(&s.bytesWritten),
+		MsgsRead:      atomic.LoadUint64(&s.msgsRead),
+		BytesRead:     atomic.LoadUint64(&s.bytesRead),
+		Spins:         atomic.LoadUint64(&s.spins),
+		Parks:         atomic.LoadUint64(&s.parks),
+		NotifyErrors:  atomic.LoadUint64(&s.notifyErrors),
+		WriteTimeouts: atomic.LoadUint64(&s.writeTimeouts),
+		ReadTimeouts:  atomic.LoadUint64(&s.readTimeouts),
+		CorruptFrames: atomic.LoadUint64(&s.corruptFrames),
+		MsgsMissed:    atomic.LoadUint64(&s.missed),
+		Duplicates:    atomic.LoadUint64(&s.duplicates),
+		Overwritten:   atomic.LoadUint64(&s.overwritten),
+		FrameSizes:    s.frameSizes.snapshot(),
+		Latency:       s.latency.snapshot(),
+		WriteWait:     s.writeWait.snapshot(),
+		ReadWait:      s.readWait.snapshot(),
+	}
+}
+
+// StatsSource is anything exposing pipe statistics, e.g. a Pipe.
+type StatsSource interface {
+	Stats() Stats
+}
+
+// NamedStats is a registered pipe's snapshot.
+type NamedStats struct {
+	Name string
+	Stats
+}
+
+// Registry keeps track of pipes whose statistics should be scraped.
+type Registry struct {
+	mu      sync.RWMutex
+	sources map[string]StatsSource
+}
+
+// DefaultRegistry is the registry used by the package level helpers.
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{sources: make(map[string]StatsSource)}
+}
+
+// Register adds s under name, replacing any previous source with the same name.
+func (r *Registry) Register(name string, s StatsSource) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sources[name] = s
+}
+
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sources, name)
+}
+
+// Snapshot returns the statistics of every registered pipe ordered by name.
+func (r *Registry) Snapshot() []NamedStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	all := make([]NamedStats, 0, len(r.sources))
+	for name, s := range r.sources {
+		all = append(all, NamedStats{Name: name, Stats: s.Stats()})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+// Register adds s to the DefaultRegistry.
+func Register(name string, s StatsSource) {
+	DefaultRegistry.Register(name, s)
+}
+
+// Unregister removes name from the DefaultRegistry.
+func Unregister(name string) {
+	DefaultRegistry.Unregister(name)
+}
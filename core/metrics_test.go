@@ -0,0 +1,113 @@
+package conn
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPipeStats(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	pipeWriter := newMemPipe(conn1)
+	pipeRecv := newMemPipe(conn2)
+	conn2.cantWrite = true
+
+	const iters = 10
+	payload := []byte("stats payload")
+	for i := 0; i < iters; i++ {
+		if err := pipeWriter.WriteMsg(NewMessage(1, payload, len(payload))); err != nil {
+			t.Fatalf("write msg error: %v", err)
+		}
+		if s := pipeWriter.Stats(); s.Pending != 1 {
+			t.Fatalf("expected the written frame pending, got %v", s.Pending)
+		}
+		if _, err := pipeRecv.ReadMsg(); err != nil {
+			t.Fatalf("read msg error: %v", err)
+		}
+		if s := pipeWriter.Stats(); s.Pending != 0 {
+			t.Fatalf("expected nothing pending after the read, got %v", s.Pending)
+		}
+	}
+
+	pipeRecv.SetReadDeadline(time.Millisecond)
+	if _, err := pipeRecv.ReadMsg(); !errors.Is(err, ErrReadTimedout) {
+		t.Fatalf("expected read timeout, got: %v", err)
+	}
+
+	frameSize := uint64(len(payload) + 4)
+	ws, rs := pipeWriter.Stats(), pipeRecv.Stats()
+	if ws.Role != RoleWriter || rs.Role != RoleReader {
+		t.Fatalf("wrong roles: %v, %v", ws.Role, rs.Role)
+	}
+	if ws.MsgsWritten != iters || ws.BytesWritten != iters*frameSize {
+		t.Fatalf("wrong write counters: %v msgs, %v bytes", ws.MsgsWritten, ws.BytesWritten)
+	}
+	if rs.MsgsRead != iters || rs.BytesRead != iters*frameSize {
+		t.Fatalf("wrong read counters: %v msgs, %v bytes", rs.MsgsRead, rs.BytesRead)
+	}
+	if rs.ReadTimeouts != 1 || rs.ReadWait.Sum < uint64(time.Millisecond) || rs.Spins == 0 {
+		t.Fatalf("wrong wait counters: %v timeouts, %+v wait, %v spins", rs.ReadTimeouts, rs.ReadWait, rs.Spins)
+	}
+	// every read waited, the timed out one included
+	if ws.WriteWait.Count == 0 || rs.ReadWait.Count != iters+1 {
+		t.Fatalf("wrong wait counts: %v writes, %v reads", ws.WriteWait.Count, rs.ReadWait.Count)
+	}
+	if ws.FrameSizes.Count != iters || ws.FrameSizes.Mean() != float64(frameSize) {
+		t.Fatalf("wrong frame size histogram: %+v", ws.FrameSizes)
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	tests := []struct {
+		v      uint64
+		bucket int
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 1},
+		{3, 2},
+		{4, 2},
+		{16, 4},
+		{17, 5},
+		{1 << 39, 39},
+		{1<<39 + 1, histogramBuckets - 1},
+		{1 << 63, histogramBuckets - 1},
+	}
+	for _, tt := range tests {
+		var h histogram
+		h.observe(tt.v)
+		s := h.snapshot()
+		if s.Buckets[tt.bucket] != 1 {
+			t.Fatalf("%v not counted in bucket %v: %v", tt.v, tt.bucket, s.Buckets)
+		}
+		// prometheus buckets are inclusive
+		if tt.bucket < histogramBuckets-1 && (tt.v > s.UpperBound(tt.bucket) || tt.bucket > 0 && tt.v <= s.UpperBound(tt.bucket-1)) {
+			t.Fatalf("%v outside the bounds of bucket %v", tt.v, tt.bucket)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	r.Register("b", statsFunc(func() Stats { return Stats{Key: 2} }))
+	r.Register("a", statsFunc(func() Stats { return Stats{Key: 1} }))
+
+	all := r.Snapshot()
+	if len(all) != 2 || all[0].Name != "a" || all[0].Key != 1 || all[1].Name != "b" {
+		t.Fatalf("wrong snapshot: %+v", all)
+	}
+
+	r.Unregister("a")
+	if all := r.Snapshot(); len(all) != 1 || all[0].Name != "b" {
+		t.Fatalf("wrong snapshot after unregister: %+v", all)
+	}
+}
+
+type statsFunc func() Stats
+
+func (f statsFunc) Stats() Stats { return f() }
@@ -0,0 +1,446 @@
+package conn
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Exca-DK/go-mempipe/core/primitives"
+)
+
+// A duplex connection is made of two one-way pipes, one created by each side.
+// Dialers and the listener meet in a small rendezvous segment at the listen key:
+//
+//	offset 0: key of the dialer's write pipe, claimed by the dialer with CAS
+//	offset 4: key of the listener's write pipe, answered by the listener
+//	offset 8: size of the pipes
+const (
+	rendezvousSize = 16
+
+	rendezvousRequest  = 0
+	rendezvousResponse = 4
+	rendezvousPipeSize = 8
+)
+
+const (
+	// how often Accept and Dial check the rendezvous segment
+	rendezvousPoll = 100 * time.Microsecond
+
+	// how long a listener waits for a dialer to finish the handshake
+	handshakeTimeout = 5 * time.Second
+
+	// how often blocked reads and writes wake up to check deadlines and Close
+	netConnPoll = 10 * time.Millisecond
+)
+
+var (
+	ErrListenerClosed = errors.New("listener closed")
+
+	errConnClosed = errors.New("use of closed connection")
+	errPeerGone   = fmt.Errorf("peer left the connection: %w", syscall.EPIPE)
+	errHandshake  = errors.New("handshake failed")
+)
+
+// Addr is the address of a mempipe listener or connection.
+type Addr struct {
+	Key int64
+}
+
+func (a Addr) Network() string { return "mempipe" }
+func (a Addr) String() string  { return "0x" + strconv.FormatInt(a.Key, 16) }
+
+// Listener accepts duplex connections over shared memory. It implements net.Listener,
+// so it can be handed to grpc.Server.Serve.
+type Listener struct {
+	mu     sync.Mutex // guards mnt against Close
+	mem    *primitives.SharedMem
+	mnt    *primitives.SharedMemMount
+	key    int64
+	size   uint64
+	closed int32
+}
+
+// Listen creates the rendezvous segment at key. Every accepted connection
+// uses two pipes of the given size.
+func Listen(key int64, size uint64) (*Listener, error) {
+	mem, err := primitives.GetSharedMem(key, rendezvousSize, &primitives.SHMFlags{Create: true, Exclusive: true, Perms: 0600})
+	if err != nil {
+		return nil, err
+	}
+
+	mnt, err := mem.Attach(nil)
+	if err != nil {
+		mem.Remove()
+		return nil, err
+	}
+
+	mnt.Seek(rendezvousPipeSize, 0)
+	mnt.AtomicWriteUint32(uint32(size))
+	return &Listener{mem: mem, mnt: mnt, key: key, size: size}, nil
+}
+
+// Accept waits for the next dialer and completes the handshake with it.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.tryAccept()
+		if conn != nil || err != nil {
+			return conn, err
+		}
+		time.Sleep(rendezvousPoll)
+	}
+}
+
+func (l *Listener) tryAccept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if atomic.LoadInt32(&l.closed) == 1 {
+		return nil, ErrListenerClosed
+	}
+
+	l.mnt.Seek(rendezvousRequest, 0)
+	remote, err := l.mnt.AtomicReadUint32()
+	if err != nil || remote == 0 {
+		return nil, err
+	}
+
+	conn, err := l.handshake(int64(remote))
+	if err != nil {
+		// drop the request so the next dialer can proceed
+		l.mnt.Seek(rendezvousRequest, 0)
+		l.mnt.AtomicCompareAndSwapUint32(remote, 0)
+		return nil, nil
+	}
+	return conn, nil
+}
+
+func (l *Listener) handshake(remote int64) (net.Conn, error) {
+	rp, err := NewMemReadPipe(remote, l.size)
+	if err != nil {
+		return nil, err
+	}
+
+	local, wp, err := createPipe(l.size)
+	if err != nil {
+		rp.Close()
+		return nil, err
+	}
+
+	l.mnt.Seek(rendezvousResponse, 0)
+	l.mnt.AtomicWriteUint32(uint32(local))
+
+	// the dialer clears the request once it attached to our pipe
+	ts := time.Now()
+	for {
+		l.mnt.Seek(rendezvousRequest, 0)
+		req, err := l.mnt.AtomicReadUint32()
+		if err != nil || time.Since(ts) > handshakeTimeout {
+			l.mnt.Seek(rendezvousResponse, 0)
+			l.mnt.AtomicWriteUint32(0)
+			rp.Close()
+			wp.Close()
+			return nil, fmt.Errorf("%w: 0x%x", errHandshake, remote)
+		}
+		if req != uint32(remote) {
+			break
+		}
+		time.Sleep(rendezvousPoll)
+	}
+
+	return newNetConn(wp, rp, Addr{Key: local}, Addr{Key: remote})
+}
+
+// Close stops accepting and removes the rendezvous segment. Established connections stay open.
+func (l *Listener) Close() error {
+	if !atomic.CompareAndSwapInt32(&l.closed, 0, 1) {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mem.Remove()
+	return l.mnt.Close()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return Addr{Key: l.key}
+}
+
+// Dialer connects to the listener whose key is given as addr, e.g. "0xE4CA".
+// Its signature matches grpc.WithContextDialer.
+func Dialer(ctx context.Context, addr string) (net.Conn, error) {
+	key, err := strconv.ParseInt(addr, 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mempipe address %q: %w", addr, err)
+	}
+	return Dial(ctx, key)
+}
+
+// Dial connects to the listener at key.
+func Dial(ctx context.Context, key int64) (net.Conn, error) {
+	mem, err := primitives.GetSharedMem(key, rendezvousSize, &primitives.SHMFlags{Create: false, Exclusive: false, Perms: 0600})
+	if err != nil {
+		return nil, err
+	}
+
+	mnt, err := mem.Attach(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer mnt.Close()
+
+	mnt.Seek(rendezvousPipeSize, 0)
+	size, err := mnt.AtomicReadUint32()
+	if err != nil {
+		return nil, err
+	}
+
+	local, wp, err := createPipe(uint64(size))
+	if err != nil {
+		return nil, err
+	}
+
+	// claim the rendezvous slot
+	for {
+		mnt.Seek(rendezvousRequest, 0)
+		ok, err := mnt.AtomicCompareAndSwapUint32(0, uint32(local))
+		if err != nil {
+			wp.Close()
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		if err := sleepCtx(ctx, rendezvousPoll); err != nil {
+			wp.Close()
+			return nil, err
+		}
+	}
+
+	var remote uint32
+	for {
+		mnt.Seek(rendezvousResponse, 0)
+		if remote, err = mnt.AtomicReadUint32(); err != nil || remote != 0 {
+			break
+		}
+
+		mnt.Seek(rendezvousRequest, 0)
+		if req, _ := mnt.AtomicReadUint32(); req != uint32(local) {
+			// the listener gave up on us
+			err = errHandshake
+			break
+		}
+
+		if err = sleepCtx(ctx, rendezvousPoll); err != nil {
+			mnt.Seek(rendezvousRequest, 0)
+			if ok, _ := mnt.AtomicCompareAndSwapUint32(uint32(local), 0); ok {
+				break
+			}
+			// the listener picked us up already, finish the handshake
+			err = nil
+		}
+	}
+	if err != nil {
+		wp.Close()
+		return nil, err
+	}
+
+	rp, err := NewMemReadPipe(int64(remote), uint64(size))
+
+	// release the slot for the next dialer
+	mnt.Seek(rendezvousResponse, 0)
+	mnt.AtomicWriteUint32(0)
+	mnt.Seek(rendezvousRequest, 0)
+	mnt.AtomicWriteUint32(0)
+
+	if err != nil {
+		wp.Close()
+		return nil, err
+	}
+	return newNetConn(wp, rp, Addr{Key: local}, Addr{Key: int64(remote)})
+}
+
+// createPipe creates a write pipe under a random unused key.
+func createPipe(size uint64) (int64, Pipe, error) {
+	var b [4]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, nil, err
+		}
+		key := int64(binary.BigEndian.Uint32(b[:]) >> 1)
+		if key == 0 {
+			continue
+		}
+
+		p, err := NewMemWritePipe(key, size)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		return key, p, nil
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// netConn is a net.Conn made of a write pipe owned by this side and a read pipe owned by the peer.
+type netConn struct {
+	rmu, wmu sync.Mutex
+	r        *StreamReader
+	w        *StreamWriter
+	rp, wp   *pipe
+
+	local, remote Addr
+
+	closed                      int32
+	readDeadline, writeDeadline atomic.Value // time.Time
+}
+
+func newNetConn(wp, rp Pipe, local, remote Addr) (*netConn, error) {
+	w, err := NewStreamWriter(wp)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewStreamReader(rp)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &netConn{
+		r:      r,
+		w:      w,
+		rp:     r.p,
+		wp:     w.p,
+		local:  local,
+		remote: remote,
+	}
+	// the peer is attached to our pipe once the handshake is done
+	c.wp.conn.updateAttach(c.wp.conn.readers())
+	c.wp.SetWriteDeadline(netConnPoll)
+	c.rp.SetReadDeadline(netConnPoll)
+	c.readDeadline.Store(time.Time{})
+	c.writeDeadline.Store(time.Time{})
+	return c, nil
+}
+
+func (c *netConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	gone := false
+	for {
+		if atomic.LoadInt32(&c.closed) == 1 {
+			return 0, errConnClosed
+		}
+
+		n, err := c.r.Read(b)
+		if !errors.Is(err, ErrReadTimedout) {
+			return n, err
+		}
+		if expired(&c.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if gone {
+			return 0, errPeerGone
+		}
+		// read once more, what the peer wrote before it left is still delivered
+		gone = c.rp.conn.writerGone()
+	}
+}
+
+func (c *netConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	total := 0
+	for {
+		if atomic.LoadInt32(&c.closed) == 1 {
+			return total, errConnClosed
+		}
+
+		n, err := c.w.Write(b)
+		total += n
+		b = b[n:]
+		if !errors.Is(err, ErrWriteTimedout) {
+			return total, err
+		}
+		if expired(&c.writeDeadline) {
+			return total, os.ErrDeadlineExceeded
+		}
+		if c.peerGone() {
+			return total, errPeerGone
+		}
+	}
+}
+
+// peerGone reports whether the peer stopped reading our write pipe, by closing the
+// connection or by dying, so nobody is left to drain it.
+func (c *netConn) peerGone() bool {
+	return c.wp.conn.readers() == 0
+}
+
+// Close signals the end of the stream to the peer and detaches both pipes.
+func (c *netConn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+
+	// pending reads and writes notice the close within netConnPoll
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	err := c.w.Close()
+	if errors.Is(err, ErrWriteTimedout) {
+		// the peer is not reading anymore
+		err = nil
+	}
+	c.wp.Close()
+	c.rp.Close()
+	return err
+}
+
+func (c *netConn) LocalAddr() net.Addr  { return c.local }
+func (c *netConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *netConn) SetDeadline(t time.Time) error {
+	c.readDeadline.Store(t)
+	c.writeDeadline.Store(t)
+	return nil
+}
+
+func (c *netConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Store(t)
+	return nil
+}
+
+func (c *netConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Store(t)
+	return nil
+}
+
+func expired(deadline *atomic.Value) bool {
+	t := deadline.Load().(time.Time)
+	return !t.IsZero() && time.Now().After(t)
+}
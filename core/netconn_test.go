@@ -0,0 +1,262 @@
+package conn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const listenKey = 0xE4CAD
+
+// echoServer is the stand-in for a gRPC server: it serves every accepted connection until the peer closes it.
+func echoServer(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			io.Copy(c, c)
+		}()
+	}
+}
+
+func TestNetConnEcho(t *testing.T) {
+	l, err := Listen(listenKey, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go echoServer(l)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		c, err := Dialer(ctx, l.Addr().String())
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+
+		msg := bytes.Repeat([]byte("ping "), 2000)
+		go c.Write(msg)
+
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, got); err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("diff echo. got %v bytes, want %v bytes", len(got), len(msg))
+		}
+		if err := c.Close(); err != nil {
+			t.Fatalf("close error: %v", err)
+		}
+	}
+}
+
+func TestNetConnDeadline(t *testing.T) {
+	l, err := Listen(listenKey, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go echoServer(l)
+
+	c, err := Dial(context.Background(), listenKey)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = c.Read(make([]byte, 1))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("expected timeout error, got: %v", err)
+	}
+}
+
+func TestNetConnPeerClose(t *testing.T) {
+	l, err := Listen(listenKey, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	c, err := Dial(context.Background(), listenKey)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	srv := <-accepted
+	defer srv.Close()
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("close error: %v", err)
+	}
+	srv.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := srv.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF, got: %v", err)
+	}
+}
+
+func TestNetConnPeerGone(t *testing.T) {
+	l, err := Listen(listenKey, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	c, err := Dial(context.Background(), listenKey)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+	srv := <-accepted
+
+	// no deadline, the peer never reads and goes away while the write is blocked
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Write(make([]byte, 64*1024))
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	srv.Close()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, syscall.EPIPE) {
+			t.Fatalf("expected EPIPE, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write still blocked after the peer left")
+	}
+}
+
+func benchmarkPingPong(b *testing.B, l net.Listener, dial func() (net.Conn, error)) {
+	go echoServer(l)
+
+	c, err := dial()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+
+	msg := make([]byte, 128)
+	buf := make([]byte, len(msg))
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(c, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNetConnMempipe(b *testing.B) {
+	l, err := Listen(listenKey, 4096)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	benchmarkPingPong(b, l, func() (net.Conn, error) { return Dial(context.Background(), listenKey) })
+}
+
+func BenchmarkNetConnTCP(b *testing.B) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	benchmarkPingPong(b, l, func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) })
+}
+
+func BenchmarkNetConnUnix(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "bench.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	defer os.Remove(path)
+	benchmarkPingPong(b, l, func() (net.Conn, error) { return net.Dial("unix", path) })
+}
+
+func TestNetConnReadPeerGone(t *testing.T) {
+	l, err := Listen(listenKey, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	c, err := Dial(context.Background(), listenKey)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+	srv := <-accepted
+	peer := srv.(*netConn)
+	defer peer.rp.Close()
+
+	if _, err := srv.Write([]byte("a")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	// the peer's write pipe goes away without the end of the stream, as if it crashed
+	peer.wp.Close()
+
+	// no deadline, what the peer wrote is read and then the read fails
+	errc := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		if n, err := c.Read(b); err != nil || n != 1 || b[0] != 'a' {
+			errc <- fmt.Errorf("got %q: %v", b[:n], err)
+			return
+		}
+		_, err := c.Read(b)
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, syscall.EPIPE) {
+			t.Fatalf("expected EPIPE, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read still blocked after the peer left")
+	}
+}
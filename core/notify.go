@@ -0,0 +1,259 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Exca-DK/go-mempipe/core/primitives"
+)
+
+var (
+	// ErrNotifyUnavailable is returned to readers enabling notifications the writer doesn't offer.
+	ErrNotifyUnavailable = errors.New("writer doesn't offer notifications")
+
+	errNotifyWithoutSegment = errors.New("notifications need a shared memory segment")
+)
+
+// how long the writer and a subscribing reader wait for each other
+const notifyHandshakeTimeout = time.Second
+
+// notifyAddr is the abstract unix socket writers take subscriptions on.
+func notifyAddr(id int64) *net.UnixAddr {
+	return &net.UnixAddr{Name: fmt.Sprintf("@mempipe/%d", id), Net: "unixpacket"}
+}
+
+// notifySubscribers are the eventfds readers subscribed with. Every reader has its own,
+// so a reader resetting its counter doesn't swallow the wakeup of another.
+type notifySubscribers struct {
+	mu    sync.Mutex
+	conns map[*net.UnixConn]*primitives.EventFD
+	fds   atomic.Value // []*primitives.EventFD, rebuilt on every change so publish doesn't lock
+	wg    sync.WaitGroup
+}
+
+func newNotifySubscribers() *notifySubscribers {
+	s := &notifySubscribers{conns: make(map[*net.UnixConn]*primitives.EventFD)}
+	s.fds.Store([]*primitives.EventFD(nil))
+	return s
+}
+
+func (s *notifySubscribers) list() []*primitives.EventFD {
+	return s.fds.Load().([]*primitives.EventFD)
+}
+
+// add keeps efd until the reader closes conn, which it holds open while subscribed.
+func (s *notifySubscribers) add(conn *net.UnixConn, efd *primitives.EventFD) {
+	s.mu.Lock()
+	s.conns[conn] = efd
+	s.update()
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		var b [1]byte
+		// returns once the reader hung up or died
+		conn.Read(b[:])
+
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.update()
+		s.mu.Unlock()
+		conn.Close()
+		efd.Close()
+	}()
+}
+
+func (s *notifySubscribers) update() {
+	fds := make([]*primitives.EventFD, 0, len(s.conns))
+	for _, efd := range s.conns {
+		fds = append(fds, efd)
+	}
+	s.fds.Store(fds)
+}
+
+// close drops every subscriber.
+func (s *notifySubscribers) close() {
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// signal wakes every subscribed reader. A failed signal only costs the reader its
+// wakeup, it finds the frame once its park times out.
+func (s *notifySubscribers) signal(stats *pipeStats) {
+	for _, efd := range s.list() {
+		// closed when the reader unsubscribed after list was taken
+		if err := efd.Signal(); err != nil && !errors.Is(err, os.ErrClosed) {
+			atomic.AddUint64(&stats.notifyErrors, 1)
+		}
+	}
+}
+
+// enableNotify makes writers signal the readers after every publish and readers park
+// instead of spinning while the pipe is idle.
+func (c *Conn) enableNotify() error {
+	if c.session.notify != nil || c.session.subscribers != nil {
+		if !c.cantWrite || c.session.notifyEpoch == readEpoch(c.conn) {
+			return nil
+		}
+		// subscribed to a writer that is gone
+		c.closeNotify()
+	}
+	if c.mem == nil {
+		return errNotifyWithoutSegment
+	}
+	if c.cantWrite {
+		return c.subscribeNotify()
+	}
+	return c.offerNotify()
+}
+
+// offerNotify takes subscriptions of readers on the notify socket.
+func (c *Conn) offerNotify() error {
+	ln, err := net.ListenUnix("unixpacket", notifyAddr(c.mem.ID()))
+	if err != nil {
+		return err
+	}
+	if err := addFeatures(c.conn, featureNotify); err != nil {
+		ln.Close()
+		return err
+	}
+
+	subs := newNotifySubscribers()
+	c.notifyListener = ln
+	c.notifyDone = make(chan struct{})
+	c.session.subscribers = subs
+	go func() {
+		defer close(c.notifyDone)
+		for {
+			conn, err := ln.AcceptUnix()
+			if err != nil {
+				return
+			}
+			// anyone allowed to attach to the segment runs under the same user
+			if peerUID(conn) != os.Getuid() {
+				conn.Close()
+				continue
+			}
+			conn.SetDeadline(time.Now().Add(notifyHandshakeTimeout))
+			efd, err := primitives.ReceiveEventFD(conn)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			if _, err := conn.Write([]byte{0}); err != nil {
+				efd.Close()
+				conn.Close()
+				continue
+			}
+			conn.SetDeadline(time.Time{})
+			subs.add(conn, efd)
+		}
+	}()
+	return nil
+}
+
+// subscribeNotify hands an eventfd of the reader to the writer. The subscription
+// lasts as long as the connection to the notify socket.
+func (c *Conn) subscribeNotify() error {
+	c.conn.Seek(offFeatures, 0)
+	if features, _ := c.conn.AtomicReadUint32(); features&featureNotify == 0 {
+		return ErrNotifyUnavailable
+	}
+
+	efd, err := primitives.NewEventFD()
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUnix("unixpacket", nil, notifyAddr(c.mem.ID()))
+	if err != nil {
+		efd.Close()
+		return fmt.Errorf("%w: %v", ErrNotifyUnavailable, err)
+	}
+	conn.SetDeadline(time.Now().Add(notifyHandshakeTimeout))
+
+	var ack [1]byte
+	if err := efd.Send(conn); err == nil {
+		_, err = conn.Read(ack[:])
+	}
+	if err != nil {
+		conn.Close()
+		efd.Close()
+		return fmt.Errorf("%w: %v", ErrNotifyUnavailable, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.notifyConn = conn
+	c.session.notify = efd
+	c.session.notifyEpoch = readEpoch(c.conn)
+	return nil
+}
+
+func (c *Conn) closeNotify() {
+	if c.notifyListener != nil {
+		c.notifyListener.Close()
+		<-c.notifyDone
+		c.notifyListener = nil
+	}
+	if c.session.subscribers != nil {
+		c.session.subscribers.close()
+		c.session.subscribers = nil
+	}
+	if c.notifyConn != nil {
+		c.notifyConn.Close()
+		c.notifyConn = nil
+	}
+	if c.session.notify != nil {
+		c.session.notify.Close()
+		c.session.notify = nil
+	}
+}
+
+func peerUID(conn *net.UnixConn) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return -1
+	}
+	uid := -1
+	raw.Control(func(fd uintptr) {
+		if cred, err := syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED); err == nil {
+			uid = int(cred.Uid)
+		}
+	})
+	return uid
+}
+
+// park sleeps until the writer publishes, the read deadline passes or the idle hook is due.
+//
+// A writer taking over the segment doesn't know the subscriptions of its predecessor, the
+// reader goes back to spinning until notifications are enabled again.
+func (h *sessionState) park(conn *primitives.SharedMemMount, since time.Time) error {
+	if readEpoch(conn) != h.notifyEpoch {
+		h.notify.Close()
+		h.notify = nil
+		return nil
+	}
+
+	timeout := idleCheckInterval
+	if h.readDeadline != -1 {
+		if left := h.readDeadline - time.Since(since); left < timeout {
+			timeout = left
+		}
+	}
+	if timeout <= 0 {
+		return nil
+	}
+	atomic.AddUint64(&h.stats.parks, 1)
+	_, err := h.notify.Wait(timeout)
+	return err
+}
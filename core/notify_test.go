@@ -0,0 +1,156 @@
+package conn
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	const key = 0xE4CB6
+
+	w, err := NewMemWritePipe(key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewMemReadPipe(key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w.WaitConn()
+
+	if err := r.(Notifier).EnableNotify(); !errors.Is(err, ErrNotifyUnavailable) {
+		t.Fatalf("expected %v, got %v", ErrNotifyUnavailable, err)
+	}
+	if err := w.(Notifier).EnableNotify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.(Notifier).EnableNotify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the reader sleeps until the writer publishes
+	expectAfter := func(w Pipe, payload string, idle time.Duration) {
+		t.Helper()
+		done := make(chan Msg, 1)
+		go func() {
+			msg, err := r.ReadMsg()
+			if err != nil {
+				t.Errorf("read msg error: %v", err)
+			}
+			done <- msg
+		}()
+		time.Sleep(idle)
+		if err := w.WriteMsg(NewMessage(1, []byte(payload), len(payload))); err != nil {
+			t.Fatalf("write msg error: %v", err)
+		}
+		if msg := <-done; string(msg.Payload) != payload {
+			t.Fatalf("diff msg. got: %q, want: %q", msg.Payload, payload)
+		}
+	}
+
+	r.SetReadDeadline(5 * time.Second)
+	expectAfter(w, "a", 100*time.Millisecond)
+	if s := r.(StatsSource).Stats(); s.Parks == 0 || s.Spins > 10000 {
+		t.Fatalf("reader didn't park: %v parks, %v spins", s.Parks, s.Spins)
+	}
+
+	// parking honors the read deadline
+	r.SetReadDeadline(50 * time.Millisecond)
+	ts := time.Now()
+	if _, err := r.ReadMsg(); err != ErrReadTimedout {
+		t.Fatalf("expected %v, got %v", ErrReadTimedout, err)
+	}
+	if d := time.Since(ts); d > idleCheckInterval/2 {
+		t.Fatalf("timed out after %v", d)
+	}
+
+	// a resumed writer doesn't signal the old eventfd, the reader spins until re-enabled
+	crash(t, w)
+	if w, err = ResumeMemWritePipe(key, 4096); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	r.SetReadDeadline(5 * time.Second)
+	expectAfter(w, "b", 10*time.Millisecond)
+
+	if err := w.(Notifier).EnableNotify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.(Notifier).EnableNotify(); err != nil {
+		t.Fatal(err)
+	}
+	parks := r.(StatsSource).Stats().Parks
+	expectAfter(w, "c", 100*time.Millisecond)
+	if r.(StatsSource).Stats().Parks == parks {
+		t.Fatal("reader didn't park after enabling notifications again")
+	}
+}
+
+func TestNotifySubscribers(t *testing.T) {
+	const id = 0xE4CB8
+
+	pub, err := NewPublisher(id, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if err := pub.conn.enableNotify(); err != nil {
+		t.Fatal(err)
+	}
+
+	var subs []*Subscriber
+	for i := 0; i < 2; i++ {
+		sub, err := Subscribe(id, 4096, "*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+		if err := sub.conn.enableNotify(); err != nil {
+			t.Fatal(err)
+		}
+		sub.SetReadDeadline(5 * time.Second)
+		subs = append(subs, sub)
+	}
+	pub.WaitSubscribers(2)
+
+	// every reader parks on its own eventfd, one publish wakes both
+	done := make(chan time.Time, len(subs))
+	for _, sub := range subs {
+		go func(sub *Subscriber) {
+			if _, err := sub.ReadMsg(); err != nil {
+				t.Errorf("read msg error: %v", err)
+			}
+			done <- time.Now()
+		}(sub)
+	}
+	time.Sleep(100 * time.Millisecond)
+	ts := time.Now()
+	if err := pub.Publish("a", nil); err != nil {
+		t.Fatal(err)
+	}
+	for range subs {
+		if d := (<-done).Sub(ts); d > idleCheckInterval/2 {
+			t.Fatalf("reader woke up after %v", d)
+		}
+	}
+	for _, sub := range subs {
+		if sub.Stats().Parks == 0 {
+			t.Fatal("reader didn't park")
+		}
+	}
+
+	// closing a reader ends its subscription
+	subs[1].Close()
+	deadline := time.Now().Add(time.Second)
+	for len(pub.conn.session.subscribers.list()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v subscribers left", len(pub.conn.session.subscribers.list()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if s := pub.Stats(); s.NotifyErrors != 0 {
+		t.Fatalf("%v notify errors", s.NotifyErrors)
+	}
+}
@@ -1,7 +1,7 @@
 package conn
 
 import (
-	"fmt"
+	"context"
 	"sync"
 	"time"
 
@@ -14,9 +14,65 @@ type Pipe interface {
 	WaitConn() // waits for client to attach
 }
 
+// The pipes of this package offer more than Pipe through the optional interfaces
+// below, check for them with a type assertion. Stats are offered as StatsSource,
+// trace propagation as ContextMsgReader and ContextMsgWriter.
+
+// SendTimestamper stamps written messages with the send time, see Msg.Latency.
+type SendTimestamper interface {
+	SetSendTimestamps(enabled bool)
+}
+
+// Checksummer protects written messages with a CRC32C, readers drop frames failing
+// it with ErrCorruptFrame.
+type Checksummer interface {
+	SetChecksums(enabled bool) error
+}
+
+// WritePolicySetter decides what a writer does while the reader didn't acknowledge
+// the last message, see WritePolicy.
+type WritePolicySetter interface {
+	SetWritePolicy(policy WritePolicy, budget time.Duration) error
+}
+
+// Notifier lets idle readers sleep until the writer publishes instead of spinning,
+// both ends have to enable it.
+type Notifier interface {
+	EnableNotify() error
+}
+
+// BatchWriter publishes msgs packed into as few frames as fit the segment, readers
+// acknowledge each frame once instead of every message. WriteBatch returns how many
+// of msgs were written, none if one of them is too large for the segment on its own.
+type BatchWriter interface {
+	WriteBatch(msgs []Msg) (int, error)
+}
+
+// BatchReader waits for a frame and returns up to max of its messages, all of them if max is 0.
+type BatchReader interface {
+	ReadBatch(max int) ([]Msg, error)
+}
+
+// TryMsgReader returns the pending message, if any, without waiting for one.
+type TryMsgReader interface {
+	TryReadMsg() (Msg, bool, error)
+}
+
+// TryMsgWriter writes msg if the last one was acknowledged, without waiting for the readers.
+type TryMsgWriter interface {
+	TryWriteMsg(msg Msg) (bool, error)
+}
+
+// TracerSetter propagates trace contexts through t instead of ContextTracer.
+type TracerSetter interface {
+	SetTracer(t Tracer)
+}
+
 type pipe struct {
 	rmu, wmu sync.Mutex
+	key      int64
 	conn     *Conn
+	tracer   Tracer
 }
 
 //trigger this if failed to close the mem due to panic or other error
@@ -34,7 +90,31 @@ func (p *pipe) SetWriteDeadline(t time.Duration) {
 }
 
 func (p *pipe) SetReadDeadline(t time.Duration) {
-	p.conn.session.SetWriteDeadline(t)
+	p.conn.session.SetReadDeadline(t)
+}
+
+func (p *pipe) SetSendTimestamps(enabled bool) {
+	p.conn.session.SetSendTimestamps(enabled)
+}
+
+func (p *pipe) SetChecksums(enabled bool) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	return p.conn.setChecksums(enabled)
+}
+
+func (p *pipe) SetWritePolicy(policy WritePolicy, budget time.Duration) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	return p.conn.setWritePolicy(policy, budget)
+}
+
+func (p *pipe) EnableNotify() error {
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	return p.conn.enableNotify()
 }
 
 // Is able to send messages. New message is only being sent when previous has been acknowledged by recv.
@@ -48,50 +128,151 @@ func NewMemWritePipe(id int64, size uint64) (Pipe, error) {
 	if err != nil {
 		return nil, err
 	}
-	return newMemPipe(conn), nil
+	conn.setKey(id)
+	p := newMemPipe(conn)
+	p.key = id
+	return p, nil
+}
+
+// ResumeMemWritePipe continues the pipe at key after its writer went away, e.g. when the
+// writing process restarts after a crash. Attached readers keep reading as if nothing happened.
+// The segment is found even if a reader already removed its key.
+func ResumeMemWritePipe(id int64, size uint64) (Pipe, error) {
+	s, err := StatSegment(id)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := ResumeWriteOnlyConn(primitives.OpenSharedMem(s.ID, size))
+	if err != nil {
+		return nil, err
+	}
+	p := newMemPipe(conn)
+	p.key = id
+	return p, nil
 }
 
 // Can only recv messages.
 func NewMemReadPipe(id int64, size uint64) (Pipe, error) {
 	prim, err := primitives.GetSharedMem(id, size, &primitives.SHMFlags{Create: false, Exclusive: false, Perms: 0600})
 	if err != nil {
-		fmt.Println("123")
 		return nil, err
 	}
 
 	conn, err := NewReadOnlyConn(prim)
 	if err != nil {
-		fmt.Println("321")
 		return nil, err
 	}
 	prim.Remove()
-	return newMemPipe(conn), nil
+	p := newMemPipe(conn)
+	p.key = id
+	return p, nil
 }
 
 func newMemPipe(prim *Conn) *pipe {
 	return &pipe{
-		conn: prim,
+		conn:   prim,
+		tracer: ContextTracer{},
 	}
 }
 
+func (t *pipe) SetTracer(tracer Tracer) {
+	t.rmu.Lock()
+	defer t.rmu.Unlock()
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+
+	t.tracer = tracer
+}
+
 func (t *pipe) ReadMsg() (Msg, error) {
 	t.rmu.Lock()
 	defer t.rmu.Unlock()
 
 	var msg Msg
 
-	code, data, _, err := t.conn.Read()
+	f, err := t.conn.readFrame()
 	if err == nil {
-		msg = Msg{
-			Code:    uint64(code),
-			Size:    uint32(len(data)),
-			Payload: data,
-		}
-		msg.setTimestamp(time.Now())
+		msg = msgFromFrame(&f)
 	}
 	return msg, err
 }
 
+func (t *pipe) ReadBatch(max int) ([]Msg, error) {
+	t.rmu.Lock()
+	defer t.rmu.Unlock()
+
+	frames, err := t.conn.readFrames(max)
+	if err != nil {
+		return nil, err
+	}
+	return msgsFromFrames(frames), nil
+}
+
+func msgsFromFrames(frames []frame) []Msg {
+	msgs := make([]Msg, len(frames))
+	for i := range frames {
+		msgs[i] = msgFromFrame(&frames[i])
+	}
+	return msgs
+}
+
+func (t *pipe) TryReadMsg() (Msg, bool, error) {
+	t.rmu.Lock()
+	defer t.rmu.Unlock()
+
+	f, ok, err := t.conn.tryReadFrame()
+	if !ok {
+		return Msg{}, false, err
+	}
+	return msgFromFrame(&f), true, nil
+}
+
+// ReadMsgContext reads a message and returns ctx extended with the span it was sent under.
+func (t *pipe) ReadMsgContext(ctx context.Context) (context.Context, Msg, error) {
+	t.rmu.Lock()
+	defer t.rmu.Unlock()
+
+	f, err := t.conn.readFrame()
+	if err != nil {
+		return ctx, Msg{}, err
+	}
+
+	msg := msgFromFrame(&f)
+	if msg.Trace.IsValid() {
+		ctx = t.tracer.Extract(ctx, msg.Trace)
+	}
+	return ctx, msg, nil
+}
+
+func msgFromFrame(f *frame) Msg {
+	msg := Msg{
+		Code:         uint64(f.code),
+		Size:         uint32(len(f.payload)),
+		Topic:        f.topic,
+		Payload:      f.payload,
+		SentAt:       f.sentAt,
+		Trace:        f.trace,
+		Header:       f.header,
+		Seq:          f.seq,
+		Missed:       f.missed,
+		Dropped:      f.dropped,
+		receivedMono: f.receivedAt,
+	}
+	msg.setTimestamp(time.Now())
+	return msg
+}
+
+func frameFromMsg(msg *Msg) *frame {
+	return &frame{
+		code:    uint32(msg.Code),
+		topic:   msg.Topic,
+		trace:   msg.Trace,
+		header:  msg.Header,
+		payload: msg.Payload,
+	}
+}
+
 func (t *pipe) WaitConn() {
 	now := t.conn.session.attached
 	if now != 0 {
@@ -99,7 +280,7 @@ func (t *pipe) WaitConn() {
 	}
 
 	for {
-		refreshed := t.conn.getRefreshAttachC()
+		refreshed := t.conn.readers()
 		if refreshed != now {
 			t.conn.updateAttach(refreshed)
 			return
@@ -113,7 +294,7 @@ func (t *pipe) WriteMsg(msg Msg) error {
 	t.wmu.Lock()
 	defer t.wmu.Unlock()
 
-	_, err := t.conn.Write(uint32(msg.Code), msg.Payload)
+	_, err := t.conn.writeFrame(frameFromMsg(&msg))
 	if err != nil {
 		return err
 	}
@@ -121,6 +302,42 @@ func (t *pipe) WriteMsg(msg Msg) error {
 	return nil
 }
 
+func (t *pipe) WriteBatch(msgs []Msg) (int, error) {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+
+	frames := make([]frame, len(msgs))
+	for i := range msgs {
+		frames[i] = *frameFromMsg(&msgs[i])
+	}
+	return t.conn.writeBatch(frames)
+}
+
+func (t *pipe) TryWriteMsg(msg Msg) (bool, error) {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+
+	return t.conn.tryWriteFrame(frameFromMsg(&msg))
+}
+
+// WriteMsgContext writes msg along with the span of ctx, unless msg carries a span already.
+func (t *pipe) WriteMsgContext(ctx context.Context, msg Msg) error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+
+	if !msg.Trace.IsValid() {
+		msg.Trace = t.tracer.Inject(ctx)
+	}
+	_, err := t.conn.writeFrame(frameFromMsg(&msg))
+	return err
+}
+
+func (t *pipe) Stats() Stats {
+	s := t.conn.Stats()
+	s.Key = t.key
+	return s
+}
+
 func (t *pipe) Close() {
 	t.wmu.Lock()
 	defer t.wmu.Unlock()
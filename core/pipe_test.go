@@ -3,15 +3,23 @@ package conn
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
 
 func TestPipe(t *testing.T) {
-	conn1 := connSetup(t, true, 1024*10)
-	conn2 := connSetup(t, false, 1024*10)
+	conn1 := connSetup(t, true, 1024*11)
+	conn2 := connSetup(t, false, 1024*11)
 	defer conn2.Close()
 	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
 
 	var (
 		iters   = 100
@@ -79,3 +87,684 @@ func TestCpuUsage(t *testing.T) {
 		}
 	}
 }
+
+func TestSendTimestamps(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	pipeWriter := newMemPipe(conn1)
+	pipeRecv := newMemPipe(conn2)
+
+	payload := []byte("timestamped")
+	if err := pipeWriter.WriteMsg(NewMessage(1, payload, len(payload))); err != nil {
+		t.Fatalf("write msg error: %v", err)
+	}
+	msg, err := pipeRecv.ReadMsg()
+	if err != nil {
+		t.Fatalf("read msg error: %v", err)
+	}
+	if msg.SentAt != 0 || msg.Latency() != 0 {
+		t.Fatalf("unexpected timestamp: %v", msg.SentAt)
+	}
+
+	pipeWriter.SetSendTimestamps(true)
+	if err := pipeWriter.WriteMsg(NewMessage(2, payload, len(payload))); err != nil {
+		t.Fatalf("write msg error: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	msg, err = pipeRecv.ReadMsg()
+	if err != nil {
+		t.Fatalf("read msg error: %v", err)
+	}
+	if msg.SentAt == 0 || msg.Latency() < time.Millisecond || msg.Latency() > time.Second {
+		t.Fatalf("wrong latency: %v", msg.Latency())
+	}
+	if string(msg.Payload) != string(payload) || msg.Code != 2 {
+		t.Fatalf("diff msg. got: %v, want: %v", string(msg.Payload), string(payload))
+	}
+	if lat := pipeRecv.Stats().Latency; lat.Count != 1 || lat.Sum != uint64(msg.Latency()) {
+		t.Fatalf("wrong latency histogram: %+v", lat)
+	}
+}
+
+func TestMessageHeader(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	pipeWriter := newMemPipe(conn1)
+	pipeRecv := newMemPipe(conn2)
+
+	payload := []byte("with header")
+	msg := NewMessage(1, payload, len(payload))
+	msg.Header = Header{"content-type": "application/json", "schema": "v2", "empty": ""}
+	if err := pipeWriter.WriteMsg(msg); err != nil {
+		t.Fatalf("write msg error: %v", err)
+	}
+	got, err := pipeRecv.ReadMsg()
+	if err != nil {
+		t.Fatalf("read msg error: %v", err)
+	}
+	if len(got.Header) != 3 || got.Header.Get("content-type") != "application/json" || got.Header.Get("schema") != "v2" {
+		t.Fatalf("diff header. got: %v, want: %v", got.Header, msg.Header)
+	}
+	if _, ok := got.Header["empty"]; !ok {
+		t.Fatalf("missing empty value")
+	}
+	if string(got.Payload) != string(payload) {
+		t.Fatalf("diff msg. got: %v, want: %v", string(got.Payload), string(payload))
+	}
+
+	// frames without a header carry none
+	if err := pipeWriter.WriteMsg(NewMessage(2, payload, len(payload))); err != nil {
+		t.Fatalf("write msg error: %v", err)
+	}
+	if got, err = pipeRecv.ReadMsg(); err != nil {
+		t.Fatalf("read msg error: %v", err)
+	}
+	if got.Header != nil {
+		t.Fatalf("unexpected header: %v", got.Header)
+	}
+
+	msg.Header = Header{string(make([]byte, maxHeaderKeyLen+1)): ""}
+	if err := pipeWriter.WriteMsg(msg); err != errHeaderTooLarge {
+		t.Fatalf("expected %v, got %v", errHeaderTooLarge, err)
+	}
+}
+
+func TestIncompatibleSegment(t *testing.T) {
+	const key = 0xE4CB1
+
+	w, err := NewMemWritePipe(key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	wc := w.(*pipe).conn.conn
+
+	if _, err := NewMemReadPipe(key, 2048); !errors.Is(err, ErrIncompatibleSegment) {
+		t.Fatalf("expected %v, got %v", ErrIncompatibleSegment, err)
+	}
+
+	wc.Seek(offVersion, 0)
+	wc.AtomicWriteUint32(protocolVersion + 1)
+	if _, err := NewMemReadPipe(key, 4096); !errors.Is(err, ErrIncompatibleSegment) {
+		t.Fatalf("expected %v, got %v", ErrIncompatibleSegment, err)
+	}
+	wc.Seek(offVersion, 0)
+	wc.AtomicWriteUint32(protocolVersion)
+
+	wc.Seek(offFeatures, 0)
+	wc.AtomicWriteUint32(knownFeatures | 1<<31)
+	if _, err := NewMemReadPipe(key, 4096); !errors.Is(err, ErrIncompatibleSegment) {
+		t.Fatalf("expected %v, got %v", ErrIncompatibleSegment, err)
+	}
+	wc.Seek(offFeatures, 0)
+	wc.AtomicWriteUint32(knownFeatures)
+
+	// failed attempts leave the segment in place
+	r, err := NewMemReadPipe(key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+}
+
+func TestReadPipeWithoutHeader(t *testing.T) {
+	conn := connSetup(t, true, 4096)
+	defer conn.Close()
+	defer conn.mem.Remove()
+
+	if _, err := NewMemReadPipe(0xE4CAB, 4096); !errors.Is(err, ErrIncompatibleSegment) {
+		t.Fatalf("expected %v, got %v", ErrIncompatibleSegment, err)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	pipeWriter := newMemPipe(conn1)
+	pipeRecv := newMemPipe(conn2)
+	if err := pipeWriter.SetChecksums(true); err != nil {
+		t.Fatal(err)
+	}
+	conn2.conn.Seek(offFeatures, 0)
+	if features, _ := conn2.conn.AtomicReadUint32(); features&featureChecksums == 0 {
+		t.Fatalf("checksums not announced: %#x", features)
+	}
+
+	payload := []byte("checked payload")
+	write := func() {
+		t.Helper()
+		msg := NewMessage(1, payload, len(payload))
+		msg.Topic = "topic"
+		if err := pipeWriter.WriteMsg(msg); err != nil {
+			t.Fatalf("write msg error: %v", err)
+		}
+	}
+	expectCorrupt := func() {
+		t.Helper()
+		if _, err := pipeRecv.ReadMsg(); !errors.Is(err, ErrCorruptFrame) {
+			t.Fatalf("expected %v, got %v", ErrCorruptFrame, err)
+		}
+	}
+
+	write()
+	got, err := pipeRecv.ReadMsg()
+	if err != nil {
+		t.Fatalf("read msg error: %v", err)
+	}
+	if string(got.Payload) != string(payload) || got.Topic != "topic" {
+		t.Fatalf("diff msg. got: %q %q", got.Topic, got.Payload)
+	}
+
+	// a flipped payload byte fails the checksum
+	write()
+	conn2.conn.Seek(offSizeWord, 0)
+	word, _ := conn2.conn.AtomicReadUint32()
+	size, _ := unpackSizeWord(word)
+	conn2.conn.Seek(offCode+int64(size)-1, 0)
+	conn2.conn.Write([]byte{^payload[len(payload)-1]})
+	expectCorrupt()
+
+	// a size beyond the segment is rejected before reading
+	write()
+	conn2.conn.Seek(offSizeWord, 0)
+	conn2.conn.AtomicWriteUint32(packSizeWord(4096, frameFlagChecksum))
+	expectCorrupt()
+
+	// so are flags this build doesn't know
+	write()
+	conn2.conn.Seek(offSizeWord, 0)
+	conn2.conn.AtomicWriteUint32(word | 1<<31)
+	expectCorrupt()
+
+	// corrupt frames were acknowledged, the pipe keeps working
+	write()
+	if _, err := pipeRecv.ReadMsg(); err != nil {
+		t.Fatalf("read msg error: %v", err)
+	}
+	if s := pipeRecv.Stats(); s.CorruptFrames != 3 {
+		t.Fatalf("wrong corrupt frame count: %v", s.CorruptFrames)
+	}
+}
+
+func TestSequence(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	pipeWriter := newMemPipe(conn1)
+	pipeRecv := newMemPipe(conn2)
+	pipeRecv.SetReadDeadline(5 * time.Second)
+
+	// start right before the counters wrap
+	const start = math.MaxUint32 - 1
+	conn1.session.wc, conn1.session.rc, conn2.session.wc = start, start, start
+	conn1.conn.Seek(offSendCounter, 0)
+	conn1.conn.AtomicWriteUint32(start)
+	conn1.conn.AtomicWriteUint32(start)
+
+	write := func() {
+		t.Helper()
+		if err := pipeWriter.WriteMsg(NewMessage(1, []byte("seq"), 3)); err != nil {
+			t.Fatalf("write msg error: %v", err)
+		}
+	}
+	expect := func(seq, missed uint64) {
+		t.Helper()
+		msg, err := pipeRecv.ReadMsg()
+		if err != nil {
+			t.Fatalf("read msg error: %v", err)
+		}
+		if msg.Seq != seq || msg.Missed != missed {
+			t.Fatalf("got seq %v missed %v, want seq %v missed %v", msg.Seq, msg.Missed, seq, missed)
+		}
+	}
+
+	for seq := uint64(1); seq <= 4; seq++ {
+		write()
+		expect(seq, 0)
+	}
+
+	// two messages get replaced before the reader comes around
+	if err := pipeWriter.SetWritePolicy(WriteOverwrite, 0); err != nil {
+		t.Fatal(err)
+	}
+	write()
+	write()
+	write()
+	expect(7, 2)
+	if err := pipeWriter.SetWritePolicy(WriteBlock, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// a repeated frame is acknowledged and dropped
+	conn1.session.seq--
+	write()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- pipeWriter.WriteMsg(NewMessage(1, []byte("seq"), 3))
+	}()
+	expect(8, 0)
+	if err := <-errCh; err != nil {
+		t.Fatalf("write msg error: %v", err)
+	}
+
+	if s := pipeRecv.Stats(); s.MsgsMissed != 2 || s.Duplicates != 1 {
+		t.Fatalf("wrong sequence stats: %v missed, %v duplicates", s.MsgsMissed, s.Duplicates)
+	}
+}
+
+func TestWriteOverwrite(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	pipeWriter := newMemPipe(conn1)
+	pipeRecv := newMemPipe(conn2)
+	pipeRecv.SetReadDeadline(5 * time.Second)
+	if err := pipeWriter.SetWritePolicy(WriteOverwrite, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(payload string) {
+		t.Helper()
+		if err := pipeWriter.WriteMsg(NewMessage(1, []byte(payload), len(payload))); err != nil {
+			t.Fatalf("write msg error: %v", err)
+		}
+	}
+	expect := func(payload string, dropped uint64) {
+		t.Helper()
+		msg, err := pipeRecv.ReadMsg()
+		if err != nil {
+			t.Fatalf("read msg error: %v", err)
+		}
+		if string(msg.Payload) != payload || msg.Dropped != dropped {
+			t.Fatalf("got %q dropped %v, want %q dropped %v", msg.Payload, msg.Dropped, payload, dropped)
+		}
+	}
+
+	// the writer never waits, the reader gets the latest message
+	// and learns how many were replaced from the sequence
+	write("0")
+	expect("0", 0)
+	write("1")
+	write("2")
+	write("3")
+	expect("3", 2)
+	write("4")
+	expect("4", 0)
+
+	if err := pipeWriter.SetWritePolicy(WriteOverwrite, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	write("5")
+	ts := time.Now()
+	write("6")
+	if d := time.Since(ts); d < 50*time.Millisecond {
+		t.Fatalf("replaced before the budget: %v", d)
+	}
+	expect("6", 1)
+
+	if s := pipeWriter.Stats(); s.Overwritten != 3 {
+		t.Fatalf("wrong overwritten count: %v", s.Overwritten)
+	}
+}
+
+func TestWriteOverwriteBeforeFirstRead(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	pipeWriter := newMemPipe(conn1)
+	pipeRecv := newMemPipe(conn2)
+	pipeRecv.SetReadDeadline(5 * time.Second)
+	if err := pipeWriter.SetWritePolicy(WriteOverwrite, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// the reader attached before the first message, it missed the replaced ones
+	for _, payload := range []string{"1", "2", "3"} {
+		if err := pipeWriter.WriteMsg(NewMessage(1, []byte(payload), len(payload))); err != nil {
+			t.Fatalf("write msg error: %v", err)
+		}
+	}
+	msg, err := pipeRecv.ReadMsg()
+	if err != nil {
+		t.Fatalf("read msg error: %v", err)
+	}
+	if string(msg.Payload) != "3" || msg.Seq != 3 || msg.Missed != 2 || msg.Dropped != 2 {
+		t.Fatalf("got %q seq %v missed %v dropped %v", msg.Payload, msg.Seq, msg.Missed, msg.Dropped)
+	}
+}
+
+func TestWriteOverwriteConcurrent(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	pipeWriter := newMemPipe(conn1)
+	pipeRecv := newMemPipe(conn2)
+	pipeRecv.SetReadDeadline(5 * time.Second)
+	pipeWriter.SetWritePolicy(WriteOverwrite, 0)
+
+	payload := make([]byte, 512)
+	if err := pipeWriter.WriteMsg(NewMessage(1, payload, len(payload))); err != nil {
+		t.Fatalf("write msg error: %v", err)
+	}
+	if _, err := pipeRecv.ReadMsg(); err != nil {
+		t.Fatalf("read msg error: %v", err)
+	}
+
+	const n = 2000
+	errCh := make(chan error, 1)
+	go func() {
+		for i := uint64(2); i <= n; i++ {
+			for off := 0; off < len(payload); off += 8 {
+				binary.BigEndian.PutUint64(payload[off:], i)
+			}
+			if err := pipeWriter.WriteMsg(NewMessage(1, payload, len(payload))); err != nil {
+				errCh <- err
+				return
+			}
+			runtime.Gosched()
+		}
+		errCh <- nil
+	}()
+
+	// every message is delivered whole, the sequence accounts for the ones replaced
+	seen := uint64(1)
+	for seen < n {
+		msg, err := pipeRecv.ReadMsg()
+		if err != nil {
+			t.Fatalf("read msg error: %v", err)
+		}
+		if msg.Seq != seen+msg.Missed+1 || msg.Dropped != msg.Missed {
+			t.Fatalf("got seq %v missed %v dropped %v after %v", msg.Seq, msg.Missed, msg.Dropped, seen)
+		}
+		for off := 0; off < len(msg.Payload); off += 8 {
+			if v := binary.BigEndian.Uint64(msg.Payload[off:]); v != msg.Seq {
+				t.Fatalf("torn message %v: word %v at %v", msg.Seq, v, off)
+			}
+		}
+		seen = msg.Seq
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("write msg error: %v", err)
+	}
+}
+
+func TestWriteRing(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	pipeWriter := newMemPipe(conn1)
+	pipeRecv := newMemPipe(conn2)
+	pipeRecv.SetReadDeadline(5 * time.Second)
+	if err := pipeWriter.SetWritePolicy(WriteRing, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(payload string) {
+		t.Helper()
+		if err := pipeWriter.WriteMsg(NewMessage(1, []byte(payload), len(payload))); err != nil {
+			t.Fatalf("write msg error: %v", err)
+		}
+	}
+	expect := func(payload string, seq, dropped uint64) {
+		t.Helper()
+		msg, err := pipeRecv.ReadMsg()
+		if err != nil {
+			t.Fatalf("read msg error: %v", err)
+		}
+		if string(msg.Payload) != payload || msg.Seq != seq || msg.Dropped != dropped {
+			t.Fatalf("got %q seq %v dropped %v, want %q seq %v dropped %v", msg.Payload, msg.Seq, msg.Dropped, payload, seq, dropped)
+		}
+	}
+
+	// the writer never waits, unread messages are carried on
+	write("0")
+	expect("0", 1, 0)
+	write("1")
+	write("2")
+	write("3")
+	expect("1", 2, 0)
+	expect("2", 3, 0)
+	expect("3", 4, 0)
+
+	// only the oldest messages that don't fit the segment are dropped
+	big := func(i int) string { return strings.Repeat(strconv.Itoa(i), 1000) }
+	for i := 0; i < 10; i++ {
+		write(big(i))
+	}
+	expect(big(7), 12, 7)
+	expect(big(8), 13, 0)
+	expect(big(9), 14, 0)
+	if s := pipeWriter.Stats(); s.Overwritten != 7 {
+		t.Fatalf("wrong overwritten count: %v", s.Overwritten)
+	}
+
+	// a reader that got the replaced frame before the writer saw its ack
+	// only gets the new message of the replacement
+	write("a")
+	expect("a", 15, 0)
+	conn1.session.writable = true
+	conn1.session.replace()
+	write("b")
+	expect("b", 16, 0)
+	if s := pipeRecv.Stats(); s.Duplicates != 1 || s.MsgsMissed != 7 {
+		t.Fatalf("wrong sequence stats: %v duplicates, %v missed", s.Duplicates, s.MsgsMissed)
+	}
+}
+
+func TestWriteOverwritePeek(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	pipeWriter := newMemPipe(conn1)
+	conn2.session.readDeadline = 5 * time.Second
+	pipeWriter.SetWritePolicy(WriteOverwrite, 0)
+
+	const n = 2000
+	errCh := make(chan error, 1)
+	go func() {
+		payload := make([]byte, 512)
+		for i := uint64(1); i <= n; i++ {
+			for off := 0; off < len(payload); off += 8 {
+				binary.BigEndian.PutUint64(payload[off:], i)
+			}
+			if err := pipeWriter.WriteMsg(NewMessage(1, payload, len(payload))); err != nil {
+				errCh <- err
+				return
+			}
+			runtime.Gosched()
+		}
+		errCh <- nil
+	}()
+
+	// the frames handed to fn are copies, never torn by a replacement
+	var seen uint64
+	for seen < n {
+		err := conn2.readFunc(func(f frame) error {
+			for off := 0; off < len(f.payload); off += 8 {
+				if v := binary.BigEndian.Uint64(f.payload[off:]); v != f.seq {
+					return fmt.Errorf("torn message %v: word %v at %v", f.seq, v, off)
+				}
+			}
+			seen = f.seq
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("write msg error: %v", err)
+	}
+}
+
+func TestTryReadWrite(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	pipeWriter := newMemPipe(conn1)
+	pipeRecv := newMemPipe(conn2)
+
+	if _, ok, err := pipeRecv.TryReadMsg(); ok || err != nil {
+		t.Fatalf("read from an empty pipe: %v %v", ok, err)
+	}
+	if ok, err := pipeWriter.TryWriteMsg(NewMessage(1, []byte("a"), 1)); !ok || err != nil {
+		t.Fatalf("write to an empty pipe: %v %v", ok, err)
+	}
+	// the reader didn't acknowledge yet
+	if ok, err := pipeWriter.TryWriteMsg(NewMessage(1, []byte("b"), 1)); ok || err != nil {
+		t.Fatalf("write before the ack: %v %v", ok, err)
+	}
+
+	msg, ok, err := pipeRecv.TryReadMsg()
+	if !ok || err != nil || string(msg.Payload) != "a" || msg.Seq != 1 {
+		t.Fatalf("got %q seq %v: %v %v", msg.Payload, msg.Seq, ok, err)
+	}
+	if _, ok, _ := pipeRecv.TryReadMsg(); ok {
+		t.Fatal("read the same message twice")
+	}
+
+	if ok, err := pipeWriter.TryWriteMsg(NewMessage(1, []byte("b"), 1)); !ok || err != nil {
+		t.Fatalf("write after the ack: %v %v", ok, err)
+	}
+	pipeWriter.SetWritePolicy(WriteOverwrite, 0)
+	if ok, err := pipeWriter.TryWriteMsg(NewMessage(1, []byte("c"), 1)); !ok || err != nil {
+		t.Fatalf("overwrite: %v %v", ok, err)
+	}
+	msg, ok, err = pipeRecv.TryReadMsg()
+	if !ok || err != nil || string(msg.Payload) != "c" || msg.Dropped != 1 {
+		t.Fatalf("got %q dropped %v: %v %v", msg.Payload, msg.Dropped, ok, err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	pipeWriter := newMemPipe(conn1)
+	pipeRecv := newMemPipe(conn2)
+	pipeRecv.SetReadDeadline(5 * time.Second)
+	pipeWriter.SetChecksums(true)
+
+	batch := func(n, size int) []Msg {
+		msgs := make([]Msg, n)
+		for i := range msgs {
+			payload := bytes.Repeat([]byte{byte(i)}, size)
+			msgs[i] = NewMessage(uint64(i), payload, len(payload))
+		}
+		return msgs
+	}
+	check := func(msgs []Msg, from, seq int) {
+		t.Helper()
+		for i, msg := range msgs {
+			if msg.Code != uint64(from+i) || msg.Seq != uint64(seq+i) || msg.Missed != 0 {
+				t.Fatalf("msg %v: code %v seq %v missed %v", i, msg.Code, msg.Seq, msg.Missed)
+			}
+			for _, b := range msg.Payload {
+				if b != byte(from+i) {
+					t.Fatalf("msg %v: corrupt payload", i)
+				}
+			}
+		}
+	}
+
+	// one frame, drained at once
+	if _, err := pipeWriter.WriteBatch(batch(5, 10)); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := pipeRecv.ReadBatch(0)
+	if err != nil || len(msgs) != 5 {
+		t.Fatalf("got %v messages: %v", len(msgs), err)
+	}
+	check(msgs, 0, 1)
+
+	// the rest of a batch is read before the next frame
+	if _, err := pipeWriter.WriteBatch(batch(3, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, err = pipeRecv.ReadBatch(2); err != nil || len(msgs) != 2 {
+		t.Fatalf("got %v messages: %v", len(msgs), err)
+	}
+	check(msgs, 0, 6)
+	msg, err := pipeRecv.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check([]Msg{msg}, 2, 8)
+
+	// a batch larger than the segment is split into several frames
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := pipeWriter.WriteBatch(batch(20, 300))
+		errCh <- err
+	}()
+	got, frames := 0, 0
+	for got < 20 {
+		// payloads are only valid until the next read
+		msgs, err := pipeRecv.ReadBatch(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(msgs, got, 9+got)
+		got += len(msgs)
+		frames++
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if frames < 2 || frames > 3 {
+		t.Fatalf("20 messages took %v frames", frames)
+	}
+
+	if s := pipeRecv.Stats(); s.MsgsRead != 28 || s.MsgsMissed != 0 {
+		t.Fatalf("reader counted %v messages, %v missed", s.MsgsRead, s.MsgsMissed)
+	}
+	if s := pipeWriter.Stats(); s.MsgsWritten != 28 {
+		t.Fatalf("writer counted %v messages", s.MsgsWritten)
+	}
+
+	// nothing is written if a message can't fit the segment on its own
+	msgs = batch(3, 10)
+	msgs[2] = NewMessage(2, make([]byte, 4096), 4096)
+	if n, err := pipeWriter.WriteBatch(msgs); n != 0 || !errors.Is(err, errPlainMessageTooLarge) {
+		t.Fatalf("expected 0 written with %v, got %v with %v", errPlainMessageTooLarge, n, err)
+	}
+	if s := pipeWriter.Stats(); s.MsgsWritten != 28 {
+		t.Fatalf("writer counted %v messages", s.MsgsWritten)
+	}
+}
@@ -0,0 +1,188 @@
+package conn
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Exca-DK/go-mempipe/core/links"
+	"github.com/Exca-DK/go-mempipe/core/primitives"
+)
+
+// PollEvents selects what a Poller watches a pipe for.
+type PollEvents uint8
+
+const (
+	// PollRead reports pipes with a message pending
+	PollRead PollEvents = 1 << iota
+	// PollWrite reports pipes whose last message was acknowledged
+	PollWrite
+)
+
+// PollEvent is a pipe found ready by Poller.Wait.
+type PollEvent struct {
+	Pipe   Pipe
+	Events PollEvents
+}
+
+// Poller waits on many pipes from a single goroutine instead of one spinning
+// goroutine per pipe. Ready pipes are served with TryReadMsg and TryWriteMsg.
+//
+// Readiness is a hint, like with epoll: a pipe may turn out to have nothing to
+// read after all, e.g. when the frame was a duplicate or got replaced. Pipes busy
+// in a blocking call are skipped until it returns.
+type Poller struct {
+	mu      sync.Mutex
+	entries []pollEntry
+	ready   []PollEvent
+	woken   int32
+}
+
+type pollEntry struct {
+	pipe   Pipe
+	p      *pipe
+	events PollEvents
+}
+
+func NewPoller() *Poller {
+	return &Poller{}
+}
+
+// Add watches pipe for events, replacing the events it was added with before.
+func (p *Poller) Add(pipe Pipe, events PollEvents) error {
+	raw, err := pollable(pipe)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.entries {
+		if p.entries[i].pipe == pipe {
+			p.entries[i].events = events
+			return nil
+		}
+	}
+	p.entries = append(p.entries, pollEntry{pipe: pipe, p: raw, events: events})
+	return nil
+}
+
+// Remove stops watching pipe.
+func (p *Poller) Remove(pipe Pipe) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.entries {
+		if p.entries[i].pipe == pipe {
+			p.entries = append(p.entries[:i], p.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// Wait returns the pipes that are ready, waiting up to timeout for one. A timeout of 0
+// checks once, a negative one waits forever. Nothing is returned once the timeout passed.
+// The returned slice is valid until the next call to Wait, which must not run concurrently.
+// Wait returns early, possibly with nothing ready, once Wake is called.
+func (p *Poller) Wait(timeout time.Duration) []PollEvent {
+	ts := time.Now()
+	for i := 1; ; i++ {
+		if ready := p.poll(); len(ready) != 0 || timeout == 0 {
+			return ready
+		}
+		if atomic.CompareAndSwapInt32(&p.woken, 1, 0) {
+			return nil
+		}
+		if i%1000 == 0 && timeout > 0 && time.Since(ts) > timeout {
+			return nil
+		}
+		links.Wait()
+	}
+}
+
+// Wake makes the running Wait return, or the next one if none is running.
+// It may be called from any goroutine, e.g. to stop a Wait(-1) on shutdown.
+func (p *Poller) Wake() {
+	atomic.StoreInt32(&p.woken, 1)
+}
+
+func (p *Poller) poll() []PollEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.ready = p.ready[:0]
+	for _, e := range p.entries {
+		var events PollEvents
+		if e.events&PollRead != 0 && e.p.pollRead() {
+			events |= PollRead
+		}
+		if e.events&PollWrite != 0 && e.p.pollWrite() {
+			events |= PollWrite
+		}
+		if events != 0 {
+			p.ready = append(p.ready, PollEvent{Pipe: e.pipe, Events: events})
+		}
+	}
+	return p.ready
+}
+
+func pollable(p Pipe) (*pipe, error) {
+	switch raw := p.(type) {
+	case *pipe:
+		return raw, nil
+	case *ReconnectingPipe:
+		return raw.pipe, nil
+	}
+	return nil, errUnsupportedPipe
+}
+
+func (t *pipe) pollRead() bool {
+	if !t.rmu.TryLock() {
+		// a blocking read is in progress
+		return false
+	}
+	defer t.rmu.Unlock()
+	return t.conn.session.pollRead(t.conn.conn)
+}
+
+func (t *pipe) pollWrite() bool {
+	if !t.wmu.TryLock() {
+		return false
+	}
+	defer t.wmu.Unlock()
+	return !t.conn.cantWrite && t.conn.session.pollWrite(t.conn.conn)
+}
+
+// pollRead reports whether a frame was published since the last one read, without reading it,
+// or messages of the last batch read are still buffered.
+func (h *sessionState) pollRead(conn *primitives.SharedMemMount) bool {
+	if h.next < len(h.frames) {
+		return true
+	}
+	conn.Seek(offSendCounter, 0)
+	if c, err := conn.AtomicReadUint32(); err == nil && c != h.wc {
+		return true
+	}
+	return h.pollIdle()
+}
+
+// pollWrite reports whether TryWriteMsg would write, without taking the acknowledgements.
+func (h *sessionState) pollWrite(conn *primitives.SharedMemMount) bool {
+	if h.writable || h.lossy() && h.budget == 0 {
+		return true
+	}
+	conn.Seek(offRecvCounter, 0)
+	if c, err := conn.AtomicReadUint32(); err == nil && h.acked(c) {
+		return true
+	}
+	return h.pollIdle()
+}
+
+// pollIdle runs the idle hook on behalf of the owner of the pipe. A pipe whose hook
+// failed is reported ready, the next Try call runs the hook again and returns the error.
+func (h *sessionState) pollIdle() bool {
+	if err := h.checkIdle(); err != nil {
+		h.lastIdle = 0
+		return true
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPoller(t *testing.T) {
+	var writers, readers []Pipe
+	for _, key := range []int64{0xE4CB4, 0xE4CB5} {
+		w, err := NewMemWritePipe(key, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		r, err := NewMemReadPipe(key, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		w.WaitConn()
+		writers, readers = append(writers, w), append(readers, r)
+	}
+
+	poller := NewPoller()
+	for _, p := range readers {
+		if err := poller.Add(p, PollRead); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range writers {
+		if err := poller.Add(p, PollWrite); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := func(want ...PollEvent) {
+		t.Helper()
+		got := poller.Wait(0)
+		if len(got) != len(want) {
+			t.Fatalf("got %v ready, want %v", len(got), len(want))
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("got %+v, want %+v", got[i], want[i])
+			}
+		}
+	}
+
+	// both writers are writable, nothing to read yet
+	expect(PollEvent{writers[0], PollWrite}, PollEvent{writers[1], PollWrite})
+
+	if err := writers[1].WriteMsg(NewMessage(1, []byte("a"), 1)); err != nil {
+		t.Fatal(err)
+	}
+	expect(PollEvent{readers[1], PollRead}, PollEvent{writers[0], PollWrite})
+
+	msg, ok, err := readers[1].(TryMsgReader).TryReadMsg()
+	if !ok || err != nil || string(msg.Payload) != "a" {
+		t.Fatalf("got %q: %v %v", msg.Payload, ok, err)
+	}
+	expect(PollEvent{writers[0], PollWrite}, PollEvent{writers[1], PollWrite})
+
+	poller.Remove(writers[0])
+	poller.Remove(writers[1])
+	if ready := poller.Wait(10 * time.Millisecond); len(ready) != 0 {
+		t.Fatalf("got %+v ready", ready)
+	}
+
+	go writers[0].WriteMsg(NewMessage(1, []byte("b"), 1))
+	ready := poller.Wait(5 * time.Second)
+	if len(ready) != 1 || ready[0] != (PollEvent{readers[0], PollRead}) {
+		t.Fatalf("got %+v ready", ready)
+	}
+
+	// a reader blocked in ReadMsg doesn't stall the others
+	readers[1].SetReadDeadline(500 * time.Millisecond)
+	blocked := make(chan struct{})
+	go func() {
+		defer close(blocked)
+		readers[1].ReadMsg()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	ts := time.Now()
+	expect(PollEvent{readers[0], PollRead})
+	if d := time.Since(ts); d > 100*time.Millisecond {
+		t.Fatalf("Wait stalled on a busy pipe for %v", d)
+	}
+	<-blocked
+
+	if _, ok, err := readers[0].(TryMsgReader).TryReadMsg(); !ok || err != nil {
+		t.Fatalf("try read: %v %v", ok, err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		poller.Wake()
+	}()
+	if ready := poller.Wait(-1); len(ready) != 0 {
+		t.Fatalf("got %+v ready", ready)
+	}
+}
+
+func TestPollerBatch(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	w, r := newMemPipe(conn1), newMemPipe(conn2)
+	r.SetReadDeadline(5 * time.Second)
+
+	poller := NewPoller()
+	if err := poller.Add(r, PollRead); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []Msg{NewMessage(1, []byte("a"), 1), NewMessage(2, []byte("b"), 1), NewMessage(3, []byte("c"), 1)}
+	if _, err := w.WriteBatch(msgs); err != nil {
+		t.Fatal(err)
+	}
+	// the rest of the batch is buffered, the reader stays ready until it is drained
+	for _, want := range []string{"a", "b", "c"} {
+		if ready := poller.Wait(100 * time.Millisecond); len(ready) != 1 {
+			t.Fatalf("got %+v ready, want %q", ready, want)
+		}
+		msg, err := r.ReadMsg()
+		if err != nil || string(msg.Payload) != want {
+			t.Fatalf("got %q: %v, want %q", msg.Payload, err, want)
+		}
+	}
+	if ready := poller.Wait(10 * time.Millisecond); len(ready) != 0 {
+		t.Fatalf("got %+v ready", ready)
+	}
+}
@@ -0,0 +1,93 @@
+package primitives
+
+/*
+#include <sys/eventfd.h>
+*/
+import "C"
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+var errNoEventFD = errors.New("no eventfd received")
+
+// EventFD is a non-blocking eventfd counter. Waiting on it parks the goroutine in the
+// runtime netpoller instead of blocking a thread.
+type EventFD struct {
+	f *os.File
+}
+
+// NewEventFD creates an eventfd with a zero counter.
+func NewEventFD() (*EventFD, error) {
+	fd, err := C.eventfd(0, C.EFD_CLOEXEC|C.EFD_NONBLOCK)
+	if fd == -1 {
+		return nil, err
+	}
+	return &EventFD{os.NewFile(uintptr(fd), "eventfd")}, nil
+}
+
+// Signal adds 1 to the counter, waking a waiter.
+func (e *EventFD) Signal() error {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], 1)
+	_, err := e.f.Write(b[:])
+	return err
+}
+
+// Wait waits up to timeout for the counter to become non-zero and resets it.
+// It returns false if the timeout passed first.
+func (e *EventFD) Wait(timeout time.Duration) (bool, error) {
+	if err := e.f.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return false, err
+	}
+	var b [8]byte
+	_, err := e.f.Read(b[:])
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Send passes the eventfd to the process at the other end of conn.
+func (e *EventFD) Send(conn *net.UnixConn) error {
+	_, _, err := conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(e.f.Fd())), nil)
+	return err
+}
+
+// ReceiveEventFD takes an eventfd passed with Send.
+func ReceiveEventFD(conn *net.UnixConn) (*EventFD, error) {
+	var b [1]byte
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(b[:], oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, errNoEventFD
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return nil, errNoEventFD
+	}
+	// the file description, and with it O_NONBLOCK, is shared with the sender
+	return &EventFD{os.NewFile(uintptr(fds[0]), "eventfd")}, nil
+}
+
+// Close closes the eventfd, the counter lives on while other processes hold it.
+func (e *EventFD) Close() error {
+	return e.f.Close()
+}
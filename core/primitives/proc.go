@@ -0,0 +1,86 @@
+package primitives
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const procShm = "/proc/sysvipc/shm"
+
+// Segment is an entry of the system's shared memory segment table.
+type Segment struct {
+	Key         int64
+	ID          int64
+	Size        uint64
+	CreatorPID  int
+	LastUserPID int
+	Attaches    uint
+}
+
+// ListSharedMem enumerates every shared memory segment visible to the process.
+// Segments marked for removal are listed under key 0 until their last detach.
+func ListSharedMem() ([]Segment, error) {
+	f, err := os.Open(procShm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var segments []Segment
+	sc := bufio.NewScanner(f)
+	sc.Scan() // column names
+	for sc.Scan() {
+		s, err := parseShmLine(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", procShm, err)
+		}
+		segments = append(segments, s)
+	}
+	return segments, sc.Err()
+}
+
+// parseShmLine parses "key shmid perms size cpid lpid nattch ...".
+func parseShmLine(line string) (Segment, error) {
+	var s Segment
+	fields := strings.Fields(line)
+	if len(fields) < 7 {
+		return s, fmt.Errorf("malformed line %q", line)
+	}
+
+	var err error
+	if s.Key, err = strconv.ParseInt(fields[0], 10, 32); err != nil {
+		return s, err
+	}
+	if s.ID, err = strconv.ParseInt(fields[1], 10, 32); err != nil {
+		return s, err
+	}
+	if s.Size, err = strconv.ParseUint(fields[3], 10, 64); err != nil {
+		return s, err
+	}
+	if s.CreatorPID, err = strconv.Atoi(fields[4]); err != nil {
+		return s, err
+	}
+	if s.LastUserPID, err = strconv.Atoi(fields[5]); err != nil {
+		return s, err
+	}
+	attaches, err := strconv.ParseUint(fields[6], 10, 32)
+	if err != nil {
+		return s, err
+	}
+	s.Attaches = uint(attaches)
+	return s, nil
+}
+
+// OpenSharedMem returns the segment with the given shmid, as listed by ListSharedMem.
+// Unlike GetSharedMem it also reaches segments already marked for removal.
+func OpenSharedMem(id int64, size uint64) *SharedMem {
+	return &SharedMem{id, uint(size)}
+}
+
+// ID returns the segment's shmid.
+func (shm *SharedMem) ID() int64 {
+	return shm.id
+}
@@ -111,6 +111,30 @@ func (shma *SharedMemMount) Read(p []byte) (int, error) {
 	return int(l), err
 }
 
+// View returns up to n bytes of the segment at the current position without copying them.
+// The slice aliases shared memory, writing to it through a read-only mount faults.
+func (shma *SharedMemMount) View(n int) ([]byte, error) {
+	var err error
+
+	l := uint(n)
+	if l > (shma.length - shma.offset) {
+		l = shma.length - shma.offset
+		err = io.EOF
+	}
+	if l == 0 {
+		return nil, err
+	}
+
+	b := unsafe.Slice((*byte)(unsafe.Pointer(uintptr(shma.ptr)+uintptr(shma.offset))), l)
+	shma.offset += l
+	return b, err
+}
+
+// Size returns the length of the mapped segment.
+func (shma *SharedMemMount) Size() uint {
+	return shma.length
+}
+
 // Write places bytes into the shared memory segment.
 func (shma *SharedMemMount) GetOffset() uint {
 	return shma.offset
@@ -176,6 +200,38 @@ func (shma *SharedMemMount) AtomicWriteUint32(v uint32) error {
 	return nil
 }
 
+// AtomicAddUint32 atomically adds delta to the value at the current position and returns the new value.
+func (shma *SharedMemMount) AtomicAddUint32(delta uint32) (uint32, error) {
+	if shma.readonly {
+		// see comment on readonly field above
+		return 0, ErrReadOnlyShm
+	}
+
+	if (shma.length - shma.offset) < 4 {
+		return 0, io.ErrShortWrite
+	}
+
+	v := atomic.AddUint32((*uint32)((unsafe.Pointer)(uintptr(shma.ptr)+uintptr(shma.offset))), delta)
+	shma.offset += 4
+	return v, nil
+}
+
+// AtomicCompareAndSwapUint32 swaps the value at the current position for new if it equals old.
+func (shma *SharedMemMount) AtomicCompareAndSwapUint32(old, new uint32) (bool, error) {
+	if shma.readonly {
+		// see comment on readonly field above
+		return false, ErrReadOnlyShm
+	}
+
+	if (shma.length - shma.offset) < 4 {
+		return false, io.ErrShortWrite
+	}
+
+	swapped := atomic.CompareAndSwapUint32((*uint32)((unsafe.Pointer)(uintptr(shma.ptr)+uintptr(shma.offset))), old, new)
+	shma.offset += 4
+	return swapped, nil
+}
+
 func (shma *SharedMemMount) AtomicReadUint64() (uint64, error) {
 	if (shma.length - shma.offset) < 4 {
 		return 0, io.EOF
@@ -207,6 +263,55 @@ func (shma *SharedMemMount) AtomicReadUint32() (uint32, error) {
 	return v, nil
 }
 
+// AtomicWriteUint64At stores v at offset without moving the current position,
+// so it may be called concurrently with the other methods. offset must be 8 byte aligned.
+func (shma *SharedMemMount) AtomicWriteUint64At(offset uint, v uint64) error {
+	if shma.readonly {
+		// see comment on readonly field above
+		return ErrReadOnlyShm
+	}
+
+	if offset+8 > shma.length {
+		return io.ErrShortWrite
+	}
+
+	atomic.StoreUint64((*uint64)((unsafe.Pointer)(uintptr(shma.ptr)+uintptr(offset))), v)
+	return nil
+}
+
+// AtomicReadUint64At loads the value at offset without moving the current position.
+func (shma *SharedMemMount) AtomicReadUint64At(offset uint) (uint64, error) {
+	if offset+8 > shma.length {
+		return 0, io.EOF
+	}
+
+	return atomic.LoadUint64((*uint64)((unsafe.Pointer)(uintptr(shma.ptr) + uintptr(offset)))), nil
+}
+
+// AtomicCompareAndSwapUint64At swaps the value at offset for new if it equals old, without
+// moving the current position. offset must be 8 byte aligned.
+func (shma *SharedMemMount) AtomicCompareAndSwapUint64At(offset uint, old, new uint64) (bool, error) {
+	if shma.readonly {
+		// see comment on readonly field above
+		return false, ErrReadOnlyShm
+	}
+
+	if offset+8 > shma.length {
+		return false, io.ErrShortWrite
+	}
+
+	return atomic.CompareAndSwapUint64((*uint64)((unsafe.Pointer)(uintptr(shma.ptr)+uintptr(offset))), old, new), nil
+}
+
+// AtomicReadUint32At loads the value at offset without moving the current position.
+func (shma *SharedMemMount) AtomicReadUint32At(offset uint) (uint32, error) {
+	if offset+4 > shma.length {
+		return 0, io.EOF
+	}
+
+	return atomic.LoadUint32((*uint32)((unsafe.Pointer)(uintptr(shma.ptr) + uintptr(offset)))), nil
+}
+
 func (shma *SharedMemMount) AtomicReadUint32WithOffset(offset int32) (uint32, error) {
 	_offset := int32(shma.offset) + offset
 	if _offset < 0 || offset > int32(shma.length) {
@@ -1,6 +1,7 @@
 package primitives
 
 import (
+	"io"
 	"math"
 	"os"
 	"testing"
@@ -63,6 +64,47 @@ func TestReadAndWrite(t *testing.T) {
 	}
 }
 
+func TestView(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	s := "this is a test string"
+	if _, err := mount.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mount.Seek(5, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	view, err := mount.View(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(view) != s[5:9] {
+		t.Fatalf("mismatched view, got back %v", string(view))
+	}
+
+	copy(view, "IS A")
+	if _, err := mount.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	holder := make([]byte, len(s))
+	if _, err := mount.Read(holder); err != nil {
+		t.Fatal(err)
+	}
+	if string(holder) != "this IS A test string" {
+		t.Fatalf("view does not alias segment, got back %v", string(holder))
+	}
+
+	if _, err := mount.Seek(-2, 2); err != nil {
+		t.Fatal(err)
+	}
+	if view, err := mount.View(4); err != io.EOF || len(view) != 2 {
+		t.Fatalf("expected short view with EOF, got %v bytes, err: %v", len(view), err)
+	}
+}
+
 func TestReadAndWriteAtomicUint64(t *testing.T) {
 	shmSetup(t)
 	defer shmTeardown(t)
@@ -91,6 +133,105 @@ func TestReadAndWriteAtomicUint64(t *testing.T) {
 	}
 }
 
+func TestAtomicUint64At(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	const target uint64 = math.MaxUint64 - 1
+
+	if err := mount.AtomicWriteUint64At(16, target); err != nil {
+		t.Fatal(err)
+	}
+	if mount.GetOffset() != 0 {
+		t.Fatalf("position moved to %v", mount.GetOffset())
+	}
+
+	val, err := mount.AtomicReadUint64At(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != target {
+		t.Fatalf("different values recv. expected: %v, got: %v", target, val)
+	}
+
+	if err := mount.AtomicWriteUint64At(4096-4, target); err != io.ErrShortWrite {
+		t.Fatalf("expected %v, got %v", io.ErrShortWrite, err)
+	}
+}
+
+func TestAtomicAddUint32(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	for i := 1; i <= 3; i++ {
+		_, err := mount.Seek(0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		val, err := mount.AtomicAddUint32(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != uint32(i*2) {
+			t.Fatalf("different values recv. expected: %v, got: %v", i*2, val)
+		}
+	}
+}
+
+func TestAtomicCompareAndSwapUint32(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	for _, tc := range []struct {
+		old, new uint32
+		swapped  bool
+	}{{0, 7, true}, {0, 9, false}, {7, 9, true}} {
+		if _, err := mount.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		swapped, err := mount.AtomicCompareAndSwapUint32(tc.old, tc.new)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if swapped != tc.swapped {
+			t.Fatalf("cas %v->%v: expected swapped %v, got %v", tc.old, tc.new, tc.swapped, swapped)
+		}
+	}
+
+	if _, err := mount.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := mount.AtomicReadUint32(); val != 9 {
+		t.Fatalf("different values recv. expected: %v, got: %v", 9, val)
+	}
+}
+
+func TestAtomicCompareAndSwapUint64At(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	for _, tc := range []struct {
+		old, new uint64
+		swapped  bool
+	}{{0, 1 << 40, true}, {0, 9, false}, {1 << 40, 9, true}} {
+		swapped, err := mount.AtomicCompareAndSwapUint64At(8, tc.old, tc.new)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if swapped != tc.swapped {
+			t.Fatalf("cas %v->%v: expected swapped %v, got %v", tc.old, tc.new, tc.swapped, swapped)
+		}
+	}
+
+	if val, _ := mount.AtomicReadUint64At(8); val != 9 {
+		t.Fatalf("different values recv. expected: %v, got: %v", 9, val)
+	}
+	if _, err := mount.AtomicCompareAndSwapUint64At(4096-4, 9, 0); err != io.ErrShortWrite {
+		t.Fatalf("expected %v, got %v", io.ErrShortWrite, err)
+	}
+}
+
 func TestSHMReadOnlyError(t *testing.T) {
 	shmSetup(t)
 	defer shmTeardown(t)
@@ -195,3 +336,45 @@ func shmSetup(t *testing.T) {
 func shmTeardown(t *testing.T) {
 	mount.Close()
 }
+
+func TestListSharedMem(t *testing.T) {
+	shmSetup(t)
+	defer shmTeardown(t)
+
+	segments, err := ListSharedMem()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found *Segment
+	for i := range segments {
+		if segments[i].ID == shm.ID() {
+			found = &segments[i]
+		}
+	}
+	if found == nil {
+		t.Fatal("segment not listed")
+	}
+	// removed in setup, so it lives on under the private key
+	if found.Key != 0 {
+		t.Error("wrong key:", found.Key)
+	}
+	if found.Size != 4096 {
+		t.Error("wrong size:", found.Size)
+	}
+	if found.CreatorPID != os.Getpid() {
+		t.Error("wrong creator pid")
+	}
+	if found.Attaches != 1 {
+		t.Error("wrong number of attaches:", found.Attaches)
+	}
+
+	mnt, err := OpenSharedMem(found.ID, found.Size).Attach(&SHMAttachFlags{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mnt.Close()
+	if mnt.Size() != 4096 {
+		t.Error("wrong mount size:", mnt.Size())
+	}
+}
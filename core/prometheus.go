@@ -0,0 +1,121 @@
+package conn
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Handler serves the metrics of every registered pipe in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WritePrometheus(w)
+	})
+}
+
+// Handler serves the DefaultRegistry in the Prometheus text format.
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
+
+// PublishExpvar exports the registry's snapshot as the expvar variable name.
+// Like expvar.Publish it panics if name is already in use.
+func (r *Registry) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		all := r.Snapshot()
+		vars := make(map[string]Stats, len(all))
+		for _, s := range all {
+			vars[s.Name] = s.Stats
+		}
+		return vars
+	}))
+}
+
+type promMetric struct {
+	name, help, typ string
+	value           func(s *Stats) float64
+}
+
+var promCounters = []promMetric{
+	{"mempipe_messages_written_total", "Messages written to the pipe.", "counter", func(s *Stats) float64 { return float64(s.MsgsWritten) }},
+	{"mempipe_bytes_written_total", "Frame bytes written to the pipe.", "counter", func(s *Stats) float64 { return float64(s.BytesWritten) }},
+	{"mempipe_messages_read_total", "Messages read from the pipe.", "counter", func(s *Stats) float64 { return float64(s.MsgsRead) }},
+	{"mempipe_bytes_read_total", "Frame bytes read from the pipe.", "counter", func(s *Stats) float64 { return float64(s.BytesRead) }},
+	{"mempipe_spins_total", "Spin iterations done while waiting.", "counter", func(s *Stats) float64 { return float64(s.Spins) }},
+	{"mempipe_parks_total", "Times a reader slept until the writer notified it.", "counter", func(s *Stats) float64 { return float64(s.Parks) }},
+	{"mempipe_notify_errors_total", "Notifications the writer failed to deliver to a reader.", "counter", func(s *Stats) float64 { return float64(s.NotifyErrors) }},
+	{"mempipe_write_timeouts_total", "Writes that timed out.", "counter", func(s *Stats) float64 { return float64(s.WriteTimeouts) }},
+	{"mempipe_read_timeouts_total", "Reads that timed out.", "counter", func(s *Stats) float64 { return float64(s.ReadTimeouts) }},
+	{"mempipe_corrupt_frames_total", "Frames dropped because they failed validation.", "counter", func(s *Stats) float64 { return float64(s.CorruptFrames) }},
+	{"mempipe_messages_missed_total", "Messages skipped according to the sequence numbers.", "counter", func(s *Stats) float64 { return float64(s.MsgsMissed) }},
+	{"mempipe_duplicates_total", "Messages delivered before and dropped by the reader.", "counter", func(s *Stats) float64 { return float64(s.Duplicates) }},
+	{"mempipe_overwritten_messages_total", "Messages dropped by replacing frames before all readers acknowledged them.", "counter", func(s *Stats) float64 { return float64(s.Overwritten) }},
+	{"mempipe_pending_frames", "Frames published and not yet acknowledged by all readers.", "gauge", func(s *Stats) float64 { return float64(s.Pending) }},
+}
+
+type promHistogram struct {
+	name, help string
+	scale      float64 // multiplies the raw bucket bounds and sum
+	value      func(s *Stats) Histogram
+}
+
+var promHistograms = []promHistogram{
+	{"mempipe_frame_size_bytes", "Size of the frames on the wire.", 1, func(s *Stats) Histogram { return s.FrameSizes }},
+	{"mempipe_latency_seconds", "Time between sending and receiving of timestamped frames.", 1e-9, func(s *Stats) Histogram { return s.Latency }},
+	{"mempipe_write_wait_seconds", "Time spent waiting for the reader to acknowledge.", 1e-9, func(s *Stats) Histogram { return s.WriteWait }},
+	{"mempipe_read_wait_seconds", "Time spent waiting for the writer to publish.", 1e-9, func(s *Stats) Histogram { return s.ReadWait }},
+}
+
+// WritePrometheus writes the metrics of every registered pipe in the Prometheus text format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	all := r.Snapshot()
+	bw := bufio.NewWriter(w)
+
+	for _, m := range promCounters {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for i := range all {
+			fmt.Fprintf(bw, "%s{%s} %s\n", m.name, promLabels(&all[i]), promFloat(m.value(&all[i].Stats)))
+		}
+	}
+
+	for _, m := range promHistograms {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s histogram\n", m.name, m.help, m.name)
+		for i := range all {
+			labels := promLabels(&all[i])
+			h := m.value(&all[i].Stats)
+
+			var cumulative uint64
+			for b := 0; b < histogramBuckets-1; b++ {
+				cumulative += h.Buckets[b]
+				le := promFloat(float64(h.UpperBound(b)) * m.scale)
+				fmt.Fprintf(bw, "%s_bucket{%s,le=\"%s\"} %d\n", m.name, labels, le, cumulative)
+			}
+			// Count is loaded apart from the buckets and may lag them, the total never does
+			cumulative += h.Buckets[histogramBuckets-1]
+			fmt.Fprintf(bw, "%s_bucket{%s,le=\"+Inf\"} %d\n", m.name, labels, cumulative)
+			fmt.Fprintf(bw, "%s_sum{%s} %s\n", m.name, labels, promFloat(float64(h.Sum)*m.scale))
+			fmt.Fprintf(bw, "%s_count{%s} %d\n", m.name, labels, cumulative)
+		}
+	}
+
+	return bw.Flush()
+}
+
+func promLabels(s *NamedStats) string {
+	return fmt.Sprintf(`pipe="%s",key="%s",role="%s"`, promEscape(s.Name), Addr{Key: s.Key}, promEscape(string(s.Role)))
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promEscape(s string) string {
+	return promEscaper.Replace(s)
+}
+
+func promFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,63 @@
+package conn
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	r := NewRegistry()
+	r.Register("ticks", statsFunc(func() Stats {
+		s := Stats{Key: 0xE4CA, Role: RoleWriter, MsgsWritten: 3, BytesWritten: 60, Pending: 1}
+		s.FrameSizes.Count = 2 // taken while the last frame was being observed
+		s.FrameSizes.Sum = 60
+		s.FrameSizes.Buckets[5] = 3 // (16, 32]
+		s.WriteWait.Count = 2
+		s.WriteWait.Sum = uint64(1500 * time.Millisecond)
+		s.WriteWait.Buckets[30] = 2 // (~0.54s, ~1.07s]
+		return s
+	}))
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+
+	for _, want := range []string{
+		"# TYPE mempipe_messages_written_total counter",
+		`mempipe_messages_written_total{pipe="ticks",key="0xe4ca",role="writer"} 3`,
+		`mempipe_pending_frames{pipe="ticks",key="0xe4ca",role="writer"} 1`,
+		"# TYPE mempipe_frame_size_bytes histogram",
+		`mempipe_frame_size_bytes_bucket{pipe="ticks",key="0xe4ca",role="writer",le="16"} 0`,
+		`mempipe_frame_size_bytes_bucket{pipe="ticks",key="0xe4ca",role="writer",le="32"} 3`,
+		`mempipe_frame_size_bytes_bucket{pipe="ticks",key="0xe4ca",role="writer",le="+Inf"} 3`,
+		`mempipe_frame_size_bytes_sum{pipe="ticks",key="0xe4ca",role="writer"} 60`,
+		`mempipe_frame_size_bytes_count{pipe="ticks",key="0xe4ca",role="writer"} 3`,
+		"# TYPE mempipe_write_wait_seconds histogram",
+		`mempipe_write_wait_seconds_bucket{pipe="ticks",key="0xe4ca",role="writer",le="1.073741824"} 2`,
+		`mempipe_write_wait_seconds_sum{pipe="ticks",key="0xe4ca",role="writer"} 1.5`,
+		`mempipe_write_wait_seconds_count{pipe="ticks",key="0xe4ca",role="writer"} 2`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("missing %q in output:\n%s", want, body)
+		}
+	}
+}
+
+func TestPublishExpvar(t *testing.T) {
+	r := NewRegistry()
+	r.Register("ticks", statsFunc(func() Stats { return Stats{Key: 1, MsgsRead: 7} }))
+	r.PublishExpvar("mempipe_test")
+
+	var vars map[string]Stats
+	if err := json.Unmarshal([]byte(expvar.Get("mempipe_test").String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars["ticks"].MsgsRead != 7 {
+		t.Fatalf("wrong expvar value: %+v", vars)
+	}
+}
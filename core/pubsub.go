@@ -0,0 +1,177 @@
+package conn
+
+import (
+	"path"
+	"sync"
+	"time"
+
+	"github.com/Exca-DK/go-mempipe/core/primitives"
+)
+
+// Publisher broadcasts topic tagged messages to every subscriber attached to its segment.
+// A message is only replaced once all subscribers have acknowledged it.
+type Publisher struct {
+	mu   sync.Mutex
+	key  int64
+	conn *Conn
+}
+
+// NewPublisher creates the segment subscribers attach to.
+func NewPublisher(id int64, size uint64) (*Publisher, error) {
+	prim, err := primitives.GetSharedMem(id, size, &primitives.SHMFlags{Create: true, Exclusive: true, Perms: 0600})
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := NewWriteOnlyConn(prim)
+	if err != nil {
+		return nil, err
+	}
+	conn.setKey(id)
+	h := conn.session
+	h.broadcast = true
+	h.readers = conn.countReaders
+	h.idle = func() error {
+		// subscribers that crashed or closed are no longer waited for
+		if n := conn.readers(); n < h.attached {
+			conn.updateAttach(n)
+		}
+		return nil
+	}
+	return &Publisher{key: id, conn: conn}, nil
+}
+
+// WaitSubscribers blocks until at least n subscribers are attached. Every message
+// waits for the acknowledgements of the subscribers attached when it is published.
+// Subscribers that detach, e.g. because they crashed, stop being waited for after a while.
+func (p *Publisher) WaitSubscribers(n int) {
+	for {
+		if p.conn.readers() >= uint32(n) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Publish writes payload under the given topic.
+func (p *Publisher) Publish(topic string, payload []byte) error {
+	return p.WriteMsg(Msg{Topic: topic, Payload: payload})
+}
+
+func (p *Publisher) WriteMsg(msg Msg) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, err := p.conn.writeFrame(frameFromMsg(&msg))
+	return err
+}
+
+func (p *Publisher) SetWriteDeadline(t time.Duration) {
+	p.conn.session.SetWriteDeadline(t)
+}
+
+func (p *Publisher) SetSendTimestamps(enabled bool) {
+	p.conn.session.SetSendTimestamps(enabled)
+}
+
+// SetChecksums protects published messages with a CRC32C.
+func (p *Publisher) SetChecksums(enabled bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conn.setChecksums(enabled)
+}
+
+// SetWritePolicy decides whether a slow subscriber holds up the publisher, see WritePolicy.
+func (p *Publisher) SetWritePolicy(policy WritePolicy, budget time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conn.setWritePolicy(policy, budget)
+}
+
+func (p *Publisher) Stats() Stats {
+	s := p.conn.Stats()
+	s.Key = p.key
+	return s
+}
+
+// Close marks the segment for removal and detaches from it.
+func (p *Publisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.conn.mem.Remove()
+	p.conn.Close()
+}
+
+// Subscriber receives the messages of a Publisher whose topic matches its pattern.
+type Subscriber struct {
+	mu      sync.Mutex
+	key     int64
+	pattern string
+	conn    *Conn
+}
+
+// Subscribe attaches to the publisher's segment. Patterns use path.Match syntax,
+// e.g. "ticks/*" matches "ticks/AAPL". Only messages published after
+// subscribing are received.
+func Subscribe(id int64, size uint64, pattern string) (*Subscriber, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	prim, err := primitives.GetSharedMem(id, size, &primitives.SHMFlags{Create: false, Exclusive: false, Perms: 0600})
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := NewReadOnlyConn(prim)
+	if err != nil {
+		return nil, err
+	}
+
+	// skip whatever was published before the publisher counted us, the frame
+	// it counted last may still be on its way
+	h := conn.session
+	h.wc = conn.joinedAt - 1
+	h.uncounted, h.skipUncounted = conn.joinedAt, true
+	h.unsynced = true
+
+	return &Subscriber{key: id, pattern: pattern, conn: conn}, nil
+}
+
+// ReadMsg returns the next message matching the subscription.
+// Messages of other topics are acknowledged and dropped.
+func (s *Subscriber) ReadMsg() (Msg, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		f, err := s.conn.readFrame()
+		if err != nil {
+			return Msg{}, err
+		}
+
+		if ok, _ := path.Match(s.pattern, f.topic); !ok {
+			continue
+		}
+
+		return msgFromFrame(&f), nil
+	}
+}
+
+func (s *Subscriber) SetReadDeadline(t time.Duration) {
+	s.conn.session.SetReadDeadline(t)
+}
+
+func (s *Subscriber) Stats() Stats {
+	stats := s.conn.Stats()
+	stats.Key = s.key
+	return stats
+}
+
+func (s *Subscriber) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conn.Close()
+}
@@ -0,0 +1,217 @@
+package conn
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPubSub(t *testing.T) {
+	const id = 0xE4CAC
+
+	pub, err := NewPublisher(id, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	pub.SetWriteDeadline(5 * time.Second)
+
+	ticks, err := Subscribe(id, 4096, "ticks/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ticks.Close()
+
+	news, err := Subscribe(id, 4096, "news/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer news.Close()
+
+	pub.WaitSubscribers(2)
+
+	var (
+		iters  = 30
+		topics = []string{"ticks/AAPL", "news/AAPL", "ticks/MSFT"}
+		errCh  = make(chan error, 2)
+	)
+
+	expect := func(sub *Subscriber, want []string) {
+		sub.SetReadDeadline(5 * time.Second)
+		for _, topic := range want {
+			msg, err := sub.ReadMsg()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if msg.Topic != topic || string(msg.Payload) != "payload "+topic {
+				errCh <- fmt.Errorf("diff msg. got: %v %q, want: %v", msg.Topic, msg.Payload, topic)
+				return
+			}
+		}
+		errCh <- nil
+	}
+
+	var wantTicks, wantNews []string
+	for i := 0; i < iters; i++ {
+		topic := topics[i%len(topics)]
+		if topic[0] == 't' {
+			wantTicks = append(wantTicks, topic)
+		} else {
+			wantNews = append(wantNews, topic)
+		}
+	}
+
+	go expect(ticks, wantTicks)
+	go expect(news, wantNews)
+
+	for i := 0; i < iters; i++ {
+		topic := topics[i%len(topics)]
+		if err := pub.Publish(topic, []byte("payload "+topic)); err != nil {
+			t.Fatalf("publish error: %v", err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSubscribeBadPattern(t *testing.T) {
+	if _, err := Subscribe(0xE4CAC, 4096, "ticks/["); err == nil {
+		t.Fatal("expected bad pattern error")
+	}
+}
+
+func TestPubSubDetach(t *testing.T) {
+	const id = 0xE4CB7
+
+	pub, err := NewPublisher(id, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	pub.SetWriteDeadline(5 * time.Second)
+
+	alive, err := Subscribe(id, 4096, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alive.Close()
+	alive.SetReadDeadline(5 * time.Second)
+	gone, err := Subscribe(id, 4096, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub.WaitSubscribers(2)
+
+	// a subscriber leaving doesn't hold up the publisher
+	gone.Close()
+	for _, topic := range []string{"a", "b"} {
+		if err := pub.Publish(topic, nil); err != nil {
+			t.Fatalf("publish error: %v", err)
+		}
+		msg, err := alive.ReadMsg()
+		if err != nil || msg.Topic != topic {
+			t.Fatalf("got %q: %v", msg.Topic, err)
+		}
+	}
+
+	// nor does the last one
+	alive.Close()
+	for _, topic := range []string{"c", "d"} {
+		if err := pub.Publish(topic, nil); err != nil {
+			t.Fatalf("publish error: %v", err)
+		}
+	}
+}
+
+func TestPubSubLateSubscriber(t *testing.T) {
+	const id = 0xE4CBA
+
+	pub, err := NewPublisher(id, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	pub.SetWriteDeadline(5 * time.Second)
+
+	early, err := Subscribe(id, 4096, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer early.Close()
+	early.SetReadDeadline(5 * time.Second)
+	pub.WaitSubscribers(1)
+
+	if err := pub.Publish("x", nil); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	late, err := Subscribe(id, 4096, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+	late.SetReadDeadline(5 * time.Second)
+
+	errCh := make(chan error, 1)
+	go func() {
+		for _, topic := range []string{"y", "z"} {
+			if err := pub.Publish(topic, nil); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	expect := func(sub *Subscriber, topic string) {
+		t.Helper()
+		msg, err := sub.ReadMsg()
+		if err != nil || msg.Topic != topic {
+			t.Fatalf("got %q: %v, want %q", msg.Topic, err, topic)
+		}
+	}
+	expect(early, "x")
+	expect(late, "y")
+	// the late subscriber's acknowledgement doesn't stand in for the early one's
+	time.Sleep(50 * time.Millisecond)
+	expect(early, "y")
+	expect(early, "z")
+	expect(late, "z")
+	if err := <-errCh; err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+}
+
+func TestPubSubPublishedBeforeSubscribe(t *testing.T) {
+	const id = 0xE4CBB
+
+	pub, err := NewPublisher(id, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	pub.SetWriteDeadline(500 * time.Millisecond)
+
+	if err := pub.Publish("x", nil); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	sub, err := Subscribe(id, 4096, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	sub.SetReadDeadline(time.Second)
+	pub.WaitSubscribers(1)
+
+	// nobody was there to acknowledge x, it doesn't hold up the next message
+	if err := pub.Publish("y", nil); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	if msg, err := sub.ReadMsg(); err != nil || msg.Topic != "y" {
+		t.Fatalf("got %q: %v", msg.Topic, err)
+	}
+}
@@ -0,0 +1,339 @@
+package conn
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Exca-DK/go-mempipe/core/primitives"
+)
+
+// errReconnect ends a reader's wait once the writer moved on to a new segment.
+var errReconnect = errors.New("writer moved to a new segment")
+
+// ReconnectingPipe is a Pipe that survives restarts of the process on either end.
+//
+// A restarted writer resumes the segment its predecessor left behind, or creates a
+// new one under the same key continuing the message sequence. Readers keep reading,
+// switch to the new segment once the old writer is gone and, when restarted
+// themselves, pick up the frame nobody acknowledged yet.
+//
+// Each writer taking over bumps the pipe's epoch. Readers report the switch to the
+// reconnect handler along with the messages published meanwhile they never got.
+type ReconnectingPipe struct {
+	*pipe
+	size uint64
+
+	// reader state, guarded by the read lock of pipe
+	epoch       uint32
+	switched    bool // the writer's segment changed since the last message
+	lost        uint64
+	onReconnect func(Reconnect)
+	notify      bool // re-enable notifications with every new writer
+}
+
+// Reconnect describes a writer change observed by a reader.
+type Reconnect struct {
+	Epoch uint32
+	// NewSegment is set if the writer created a new segment instead of resuming the old one
+	NewSegment bool
+	// Lost is how many messages were skipped, 0 if the new writer started the sequence over
+	Lost uint64
+}
+
+// NewReconnectingWritePipe resumes the pipe at key if an earlier writer left it behind,
+// otherwise creates it.
+func NewReconnectingWritePipe(id int64, size uint64) (*ReconnectingPipe, error) {
+	p, err := ResumeMemWritePipe(id, size)
+	if errors.Is(err, ErrSegmentNotFound) {
+		if p, err = NewMemWritePipe(id, size); err == nil {
+			err = continuePipe(p.(*pipe).conn, id)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rp := &ReconnectingPipe{pipe: p.(*pipe), size: size}
+	h := rp.conn.session
+	h.idle = func() error {
+		// readers that joined since, or a restarted one replacing the last reader
+		if n := rp.conn.readers(); n != 0 && n != h.attached {
+			rp.conn.updateAttach(n)
+		}
+		return nil
+	}
+	return rp, nil
+}
+
+// NewReconnectingReadPipe attaches to the pipe at key, even if an earlier reader already
+// removed the key. Like NewMemReadPipe the writer has to have created it.
+func NewReconnectingReadPipe(id int64, size uint64) (*ReconnectingPipe, error) {
+	s, err := StatSegment(id)
+	if err != nil {
+		return nil, err
+	}
+	var session sessionState
+	session.readDeadline = -1
+	session.writeDeadline = -1
+	conn, err := joinPipe(s, size, &session)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newMemPipe(conn)
+	p.key = id
+	rp := &ReconnectingPipe{pipe: p, size: size}
+	rp.epoch = readEpoch(conn.conn)
+	session.idle = rp.checkWriter
+	return rp, nil
+}
+
+// continuePipe carries the sequence and epoch of the segment a new one replaces over to it.
+func continuePipe(c *Conn, key int64) error {
+	segments, err := Segments()
+	if err != nil {
+		return err
+	}
+	var seq uint64
+	var epoch uint32
+	for _, s := range segments {
+		if s.Removed() && s.PipeKey == key && s.ID != c.mem.ID() {
+			if s.Seq > seq {
+				seq = s.Seq
+			}
+			if s.Epoch > epoch {
+				epoch = s.Epoch
+			}
+		}
+	}
+	if epoch == 0 {
+		return nil
+	}
+
+	c.session.seq = seq
+	if err := c.conn.AtomicWriteUint64At(offCommit, seq<<1); err != nil {
+		return err
+	}
+	c.conn.Seek(offEpoch, 0)
+	return c.conn.AtomicWriteUint32(epoch + 1)
+}
+
+// joinPipe attaches a reader to a running pipe, taking over session.
+func joinPipe(s SegmentInfo, size uint64, session *sessionState) (*Conn, error) {
+	prim := primitives.OpenSharedMem(s.ID, size)
+	conn, err := NewReadOnlyConn(prim)
+	if err != nil {
+		return nil, err
+	}
+	prim.Remove()
+	conn.session = session
+	conn.syncReader()
+	return conn, nil
+}
+
+// syncReader positions a reader joining a pipe that's already running. The frame in
+// the slot is delivered unless a reader acknowledged it already.
+func (c *Conn) syncReader() {
+	conn, h := c.conn, c.session
+	conn.Seek(offSendCounter, 0)
+	wc, _ := conn.AtomicReadUint32()
+	rc, _ := conn.AtomicReadUint32()
+	conn.Seek(offAckBase, 0)
+	ackBase, _ := conn.AtomicReadUint32()
+	commit, _ := conn.AtomicReadUint64At(offCommit)
+
+	seq := commit >> 1
+	switch {
+	case commit&1 != 0:
+		// the next frame is being written, the one before it was acknowledged
+		seq--
+	case wc != 0 && rc == ackBase:
+		wc, seq = wc-1, seq-slotCount(conn)
+	}
+	h.wc = wc
+	// a reader moving over keeps counting unless the new writer started the sequence over
+	if h.seq == 0 || seq < h.seq {
+		h.seq = seq
+	}
+}
+
+func readEpoch(conn *primitives.SharedMemMount) uint32 {
+	conn.Seek(offEpoch, 0)
+	epoch, _ := conn.AtomicReadUint32()
+	return epoch
+}
+
+// checkWriter is the reader's idle hook. Once the writer is gone and a new segment
+// was created under the key the reader has to move over.
+func (p *ReconnectingPipe) checkWriter() error {
+	if !p.conn.writerGone() {
+		return nil
+	}
+
+	if s, err := StatSegment(p.key); err == nil && s.ID != p.conn.mem.ID() {
+		return errReconnect
+	}
+	return nil
+}
+
+// reconnect moves the reader to the writer's new segment.
+func (p *ReconnectingPipe) reconnect() error {
+	s, err := StatSegment(p.key)
+	if err != nil {
+		return err
+	}
+	old := p.conn
+	conn, err := joinPipe(s, p.size, old.session)
+	if err != nil {
+		return err
+	}
+	p.conn = conn
+	p.switched = true
+	return old.Close()
+}
+
+// Stats returns a snapshot of the counters of the segment currently read from.
+// It waits for a read in progress, which may move the reader to another segment.
+func (p *ReconnectingPipe) Stats() Stats {
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+	return p.pipe.Stats()
+}
+
+// Close detaches from the segment currently read from, after a read in progress.
+func (p *ReconnectingPipe) Close() {
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+	p.pipe.Close()
+}
+
+// EnableNotify enables notifications and keeps them enabled across writer changes,
+// as far as the new writers offer them.
+func (p *ReconnectingPipe) EnableNotify() error {
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	p.notify = true
+	return p.conn.enableNotify()
+}
+
+// SetReconnectHandler registers fn to be called before the first message read after
+// the writer changed.
+func (p *ReconnectingPipe) SetReconnectHandler(fn func(Reconnect)) {
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+	p.onReconnect = fn
+}
+
+// Lost returns how many messages readers observed to be skipped over all reconnects.
+func (p *ReconnectingPipe) Lost() uint64 {
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+	return p.lost
+}
+
+// Epoch returns the epoch of the writer the last message came from.
+func (p *ReconnectingPipe) Epoch() uint32 {
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+	return p.epoch
+}
+
+func (p *ReconnectingPipe) ReadMsg() (Msg, error) {
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+
+	f, err := p.readFrame()
+	if err != nil {
+		return Msg{}, err
+	}
+	return msgFromFrame(&f), nil
+}
+
+// TryReadMsg returns the pending message, if any. A writer change found meanwhile
+// is followed right away, the new segment is polled by the next call.
+func (p *ReconnectingPipe) TryReadMsg() (Msg, bool, error) {
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+
+	f, ok, err := p.conn.tryReadFrame()
+	if err == errReconnect {
+		return Msg{}, false, p.reconnect()
+	}
+	if !ok {
+		return Msg{}, false, err
+	}
+	p.observe(&f)
+	return msgFromFrame(&f), true, nil
+}
+
+func (p *ReconnectingPipe) ReadMsgContext(ctx context.Context) (context.Context, Msg, error) {
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+
+	f, err := p.readFrame()
+	if err != nil {
+		return ctx, Msg{}, err
+	}
+	msg := msgFromFrame(&f)
+	if msg.Trace.IsValid() {
+		ctx = p.tracer.Extract(ctx, msg.Trace)
+	}
+	return ctx, msg, nil
+}
+
+func (p *ReconnectingPipe) ReadBatch(max int) ([]Msg, error) {
+	p.rmu.Lock()
+	defer p.rmu.Unlock()
+
+	frames, err := p.readFrames(max)
+	if err != nil {
+		return nil, err
+	}
+	return msgsFromFrames(frames), nil
+}
+
+// readFrame reads the next frame, reconnecting whenever the writer moved on.
+func (p *ReconnectingPipe) readFrame() (frame, error) {
+	frames, err := p.readFrames(1)
+	if err != nil {
+		return frame{}, err
+	}
+	return frames[0], nil
+}
+
+func (p *ReconnectingPipe) readFrames(max int) ([]frame, error) {
+	for {
+		frames, err := p.conn.readFrames(max)
+		if err == errReconnect {
+			if err := p.reconnect(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err == nil {
+			p.observe(&frames[0])
+		}
+		return frames, err
+	}
+}
+
+// observe reports a writer change with the first message read from the new writer.
+func (p *ReconnectingPipe) observe(f *frame) {
+	epoch := readEpoch(p.conn.conn)
+	if epoch == p.epoch && !p.switched {
+		return
+	}
+
+	if p.notify {
+		// the reader spins if the new writer doesn't offer notifications
+		p.conn.enableNotify()
+	}
+	r := Reconnect{Epoch: epoch, NewSegment: p.switched, Lost: f.missed}
+	p.lost += r.Lost
+	p.epoch, p.switched = epoch, false
+	if p.onReconnect != nil {
+		p.onReconnect(r)
+	}
+}
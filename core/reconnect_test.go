@@ -0,0 +1,89 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectingPipe(t *testing.T) {
+	const key = 0xE4CB3
+
+	w, err := NewReconnectingWritePipe(key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReconnectingReadPipe(key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetReadDeadline(5 * time.Second)
+	var events []Reconnect
+	r.SetReconnectHandler(func(e Reconnect) { events = append(events, e) })
+
+	write := func(w *ReconnectingPipe, payload string) {
+		t.Helper()
+		if err := w.WriteMsg(NewMessage(1, []byte(payload), len(payload))); err != nil {
+			t.Fatalf("write msg error: %v", err)
+		}
+	}
+	expect := func(r *ReconnectingPipe, payload string) {
+		t.Helper()
+		msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatalf("read msg error: %v", err)
+		}
+		if string(msg.Payload) != payload {
+			t.Fatalf("diff msg. got: %q, want: %q", msg.Payload, payload)
+		}
+	}
+
+	write(w, "a")
+	expect(r, "a")
+
+	// the writer restarts and resumes the segment
+	crash(t, w.pipe)
+	if w, err = NewReconnectingWritePipe(key, 4096); err != nil {
+		t.Fatal(err)
+	}
+	write(w, "b")
+	expect(r, "b")
+	if len(events) != 1 || events[0] != (Reconnect{Epoch: 2}) {
+		t.Fatalf("wrong reconnect events: %+v", events)
+	}
+
+	// the reader restarts and gets the frame published meanwhile
+	r.Close()
+	write(w, "c")
+	if r, err = NewReconnectingReadPipe(key, 4096); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.SetReadDeadline(5 * time.Second)
+	r.SetReconnectHandler(func(e Reconnect) { events = append(events, e) })
+	expect(r, "c")
+	write(w, "d")
+	expect(r, "d")
+
+	// the writer closes and its successor creates a new segment, the sequence continues.
+	// It overwrites two messages before the reader moved over, they are lost
+	w.Close()
+	if w, err = NewReconnectingWritePipe(key, 4096); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.SetWritePolicy(WriteOverwrite, 0); err != nil {
+		t.Fatal(err)
+	}
+	write(w, "e1")
+	write(w, "e2")
+	write(w, "e3")
+	expect(r, "e3")
+	write(w, "f")
+	expect(r, "f")
+	if len(events) != 2 || events[1] != (Reconnect{Epoch: 3, NewSegment: true, Lost: 2}) {
+		t.Fatalf("wrong reconnect events: %+v", events)
+	}
+	if r.Lost() != 2 || r.Epoch() != 3 {
+		t.Fatalf("wrong reader state: lost %v, epoch %v", r.Lost(), r.Epoch())
+	}
+}
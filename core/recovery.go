@@ -0,0 +1,107 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Exca-DK/go-mempipe/core/primitives"
+)
+
+var ErrWriterActive = errors.New("segment has an active writer")
+
+// ResumeWriteOnlyConn takes over the segment of a writer that is gone, e.g. after a crash,
+// and continues its frame sequence. A frame the previous writer was still writing is
+// discarded, one it completed but didn't publish yet is published.
+//
+// Readers stay attached and see the frames of both writers as one stream.
+func ResumeWriteOnlyConn(mnt *primitives.SharedMem) (*Conn, error) {
+	var session sessionState
+	session.readDeadline = -1
+	session.writeDeadline = -1
+
+	shm, err := mnt.Attach(&primitives.SHMAttachFlags{ReadOnly: false})
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		conn:    shm,
+		session: &session,
+		mem:     mnt,
+	}
+	if err := c.resume(); err != nil {
+		shm.Close()
+		return nil, err
+	}
+	c.session.attached = c.readers()
+	c.startHeartbeat()
+	return c, nil
+}
+
+// resume claims the segment and restores the writer state from the segment header.
+func (c *Conn) resume() error {
+	conn := c.conn
+	if err := checkSegment(conn); err != nil {
+		return err
+	}
+	conn.Seek(offFeatures, 0)
+	if features, _ := conn.AtomicReadUint32(); features&featureCommit == 0 {
+		return fmt.Errorf("%w: writer state is not recorded", ErrIncompatibleSegment)
+	}
+
+	conn.Seek(offWriterPID, 0)
+	pid, err := conn.AtomicReadUint32()
+	if err != nil {
+		return err
+	}
+	if pid != 0 && processAlive(int(pid)) {
+		return fmt.Errorf("%w: pid %d", ErrWriterActive, pid)
+	}
+	conn.Seek(offWriterPID, 0)
+	if ok, err := conn.AtomicCompareAndSwapUint32(pid, uint32(os.Getpid())); err != nil {
+		return err
+	} else if !ok {
+		return ErrWriterActive
+	}
+	conn.Seek(offClosed, 0)
+	conn.AtomicWriteUint32(0)
+	conn.Seek(offEpoch, 0)
+	if _, err := conn.AtomicAddUint32(1); err != nil {
+		return err
+	}
+
+	commit, _ := conn.AtomicReadUint64At(offCommit)
+	conn.Seek(offSlotSeq, 0)
+	slotSeq, _ := conn.AtomicReadUint32()
+	conn.Seek(offSendCounter, 0)
+	wc, _ := conn.AtomicReadUint32()
+	rc, _ := conn.AtomicReadUint32()
+	conn.Seek(offAckBase, 0)
+	ackBase, _ := conn.AtomicReadUint32()
+
+	h := c.session
+	h.seq, h.wc = commit>>1, wc
+	h.count = slotCount(conn)
+	switch {
+	case commit&1 != 0:
+		// torn: the frame was never published and the previous one was acknowledged,
+		// or the writer wouldn't have started on it
+		h.seq--
+		h.rc = rc
+		h.writable = true
+		if err := conn.AtomicWriteUint64At(offCommit, h.seq<<1); err != nil {
+			return err
+		}
+		conn.Seek(offSlotSeq, 0)
+		return conn.AtomicWriteUint32(wc)
+	case slotSeq != wc:
+		// complete but not published
+		h.rc = ackBase
+		return h.publish(conn)
+	default:
+		h.rc = ackBase
+		// nothing was ever published
+		h.writable = wc == 0 && rc == 0
+		return nil
+	}
+}
@@ -0,0 +1,110 @@
+package conn
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// crash detaches w like a dead process would: no close marker and a writer pid that's gone.
+func crash(t *testing.T, w Pipe) {
+	c := w.(*pipe).conn
+	close(c.stopHeartbeat)
+	<-c.heartbeatDone
+	c.conn.Seek(offWriterPID, 0)
+	c.conn.AtomicWriteUint32(1<<31 - 1)
+	c.closeNotify()
+	if err := c.conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeWritePipe(t *testing.T) {
+	const key = 0xE4CB2
+
+	w, err := NewMemWritePipe(key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewMemReadPipe(key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.SetReadDeadline(100 * time.Millisecond)
+
+	if _, err := ResumeMemWritePipe(key, 4096); !errors.Is(err, ErrWriterActive) {
+		t.Fatalf("expected %v, got %v", ErrWriterActive, err)
+	}
+
+	write := func(w Pipe, payload string) {
+		t.Helper()
+		if err := w.WriteMsg(NewMessage(1, []byte(payload), len(payload))); err != nil {
+			t.Fatalf("write msg error: %v", err)
+		}
+	}
+	expect := func(payload string) {
+		t.Helper()
+		msg, err := r.ReadMsg()
+		if err != nil {
+			t.Fatalf("read msg error: %v", err)
+		}
+		if string(msg.Payload) != payload {
+			t.Fatalf("diff msg. got: %q, want: %q", msg.Payload, payload)
+		}
+	}
+	resume := func() Pipe {
+		t.Helper()
+		w, err := ResumeMemWritePipe(key, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	// clean crash between frames, the acknowledged frame is not repeated
+	write(w, "first")
+	expect("first")
+	crash(t, w)
+	w = resume()
+	write(w, "second")
+	expect("second")
+
+	// the writer died in the middle of a frame, it's never exposed
+	h, mnt := w.(*pipe).conn.session, w.(*pipe).conn.conn
+	h.WaitWrite(mnt)
+	h.beginWrite(mnt)
+	mnt.Seek(offSizeWord, 0)
+	mnt.AtomicWriteUint32(packSizeWord(1<<20, 0))
+	crash(t, w)
+	w = resume()
+	if _, err := r.ReadMsg(); err != ErrReadTimedout {
+		t.Fatalf("torn frame exposed: %v", err)
+	}
+	write(w, "third")
+	expect("third")
+
+	// the writer completed the frame but died before publishing it
+	h, mnt = w.(*pipe).conn.session, w.(*pipe).conn.conn
+	h.WaitWrite(mnt)
+	h.beginWrite(mnt)
+	mnt.Seek(offSizeWord, 0)
+	mnt.AtomicWriteUint32(packSizeWord(4+len("fourth"), 0))
+	mnt.Write([]byte{0, 0, 0, 1})
+	mnt.Write([]byte("fourth"))
+	mnt.AtomicWriteUint64At(offCommit, (h.seq+1)<<1)
+	crash(t, w)
+	w = resume()
+	defer w.Close()
+	expect("fourth")
+	write(w, "fifth")
+	expect("fifth")
+
+	s, err := StatSegmentID(r.(*pipe).conn.mem.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Seq != 5 || s.PipeKey != key || s.WriterPID == 0 {
+		t.Fatalf("wrong segment info: %+v", s)
+	}
+}
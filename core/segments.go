@@ -0,0 +1,272 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/Exca-DK/go-mempipe/core/links"
+	"github.com/Exca-DK/go-mempipe/core/primitives"
+)
+
+var (
+	ErrSegmentNotFound = errors.New("segment not found")
+	ErrNotPipeSegment  = errors.New("not a mempipe segment")
+)
+
+// SegmentInfo describes a mempipe segment and the frame it currently holds.
+type SegmentInfo struct {
+	primitives.Segment
+
+	LastAttach, LastDetach time.Time
+
+	SendCounter, RecvCounter uint32
+
+	// size word of the frame slot: wire size and flags of the last written frame
+	FrameSize  int
+	FrameFlags byte
+	Code       uint32
+
+	Version  uint32
+	Features uint32
+
+	// PipeKey is the key the pipe was created with, also known once the segment was removed
+	PipeKey int64
+	// WriterPID is the process writing to the segment, 0 once it closed
+	WriterPID int
+	// Seq is the sequence number of the frame in the slot
+	Seq uint64
+	// Epoch counts the writers that took over the pipe
+	Epoch uint32
+	// Readers is how many readers count themselves attached, taps and the like aren't among them
+	Readers uint32
+
+	// Closed is set once the writer closed its end
+	Closed bool
+	// Heartbeat is the time since the writer was last known alive, -1 if it never told
+	Heartbeat time.Duration
+}
+
+// Removed reports whether the segment is marked for removal and lives only until its last detach.
+func (s SegmentInfo) Removed() bool {
+	return s.Key == 0
+}
+
+// Stale reports whether nothing is attached to the segment and its writer is gone:
+// it closed the pipe, the process that created the segment died or the heartbeat
+// is older than maxAge.
+func (s SegmentInfo) Stale(maxAge time.Duration) bool {
+	if s.Attaches != 0 {
+		return false
+	}
+	return s.Closed || !processAlive(s.CreatorPID) || s.Heartbeat > maxAge
+}
+
+// Segments lists the mempipe segments visible to the process.
+// Segments that can't be attached, e.g. due to permissions, are skipped.
+func Segments() ([]SegmentInfo, error) {
+	all, err := primitives.ListSharedMem()
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []SegmentInfo
+	for _, s := range all {
+		info, err := inspectSegment(s)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, info)
+	}
+	return segments, nil
+}
+
+// StatSegment decodes the header of the mempipe segment at key. Once a reader attached
+// the key is gone from the segment, then the removed segment recorded under key that
+// readers are still attached to is used.
+func StatSegment(key int64) (SegmentInfo, error) {
+	s, err := findSegment(func(s primitives.Segment) bool { return s.Key == key })
+	if err == nil {
+		return inspectSegment(s)
+	}
+	if !errors.Is(err, ErrSegmentNotFound) {
+		return SegmentInfo{}, err
+	}
+
+	segments, err := Segments()
+	if err != nil {
+		return SegmentInfo{}, err
+	}
+	for _, s := range segments {
+		if s.Removed() && s.PipeKey == key && s.Attaches > 0 && !s.Closed {
+			return s, nil
+		}
+	}
+	return SegmentInfo{}, ErrSegmentNotFound
+}
+
+// StatSegmentID is StatSegment for a shmid. Once a reader attached, NewMemReadPipe
+// marks the segment for removal and it can only be found by its shmid.
+func StatSegmentID(id int64) (SegmentInfo, error) {
+	s, err := findSegment(func(s primitives.Segment) bool { return s.ID == id })
+	if err != nil {
+		return SegmentInfo{}, err
+	}
+	return inspectSegment(s)
+}
+
+// RemoveSegment marks the mempipe segment at key for removal.
+// Attached pipes keep working until they detach.
+func RemoveSegment(key int64) error {
+	info, err := StatSegment(key)
+	if err != nil {
+		return err
+	}
+	return primitives.OpenSharedMem(info.ID, info.Size).Remove()
+}
+
+// CollectSegments removes every stale mempipe segment and returns them,
+// see SegmentInfo.Stale.
+func CollectSegments(maxAge time.Duration) ([]SegmentInfo, error) {
+	segments, err := Segments()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []SegmentInfo
+	for _, s := range segments {
+		if s.Removed() || !s.Stale(maxAge) {
+			continue
+		}
+		if err := primitives.OpenSharedMem(s.ID, s.Size).Remove(); err != nil {
+			return removed, err
+		}
+		removed = append(removed, s)
+	}
+	return removed, nil
+}
+
+// Reclaim removes the segment at key if it is stale, so a writer can be created there again.
+// It reports whether a segment was removed. Segments that are not mempipe ones are left alone.
+//
+//	core.Reclaim(key)
+//	p, err := core.NewMemWritePipe(key, size)
+func Reclaim(key int64) (bool, error) {
+	s, err := StatSegment(key)
+	if errors.Is(err, ErrSegmentNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !s.Stale(StaleAfter) {
+		return false, nil
+	}
+	if err := primitives.OpenSharedMem(s.ID, s.Size).Remove(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RunJanitor removes stale segments every interval until ctx is cancelled.
+// removed, if not nil, is called for every segment removed.
+func RunJanitor(ctx context.Context, interval time.Duration, removed func(SegmentInfo)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		// errors are transient, e.g. a segment vanished while listing
+		segments, _ := CollectSegments(StaleAfter)
+		if removed != nil {
+			for _, s := range segments {
+				removed(s)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func findSegment(match func(primitives.Segment) bool) (primitives.Segment, error) {
+	all, err := primitives.ListSharedMem()
+	if err != nil {
+		return primitives.Segment{}, err
+	}
+	for _, s := range all {
+		if match(s) {
+			return s, nil
+		}
+	}
+	return primitives.Segment{}, ErrSegmentNotFound
+}
+
+func inspectSegment(s primitives.Segment) (SegmentInfo, error) {
+	info := SegmentInfo{Segment: s}
+	if s.Size < offPayload {
+		return info, ErrNotPipeSegment
+	}
+
+	mem := primitives.OpenSharedMem(s.ID, s.Size)
+	// stat before attaching so we don't show up in it
+	stat, err := mem.Stat()
+	if err != nil {
+		return info, err
+	}
+	info.Attaches = stat.CurrentAttaches
+	info.LastAttach = stat.LastAttach
+	info.LastDetach = stat.LastDetach
+
+	mnt, err := mem.Attach(&primitives.SHMAttachFlags{ReadOnly: true})
+	if err != nil {
+		return info, err
+	}
+	defer mnt.Close()
+
+	mnt.Seek(offMagic, 0)
+	if magic, err := mnt.AtomicReadUint32(); err != nil || magic != segmentMagic {
+		return info, ErrNotPipeSegment
+	}
+
+	mnt.Seek(offSendCounter, 0)
+	info.SendCounter, _ = mnt.AtomicReadUint32()
+	info.RecvCounter, _ = mnt.AtomicReadUint32()
+	word, _ := mnt.AtomicReadUint32()
+	info.FrameSize, info.FrameFlags = unpackSizeWord(word)
+	var code [4]byte
+	mnt.Read(code[:])
+	info.Code = uint32(bytesToInt(code[:]))
+
+	info.Heartbeat = -1
+	if hb, _ := mnt.AtomicReadUint64At(offHeartbeat); hb != 0 {
+		info.Heartbeat = time.Duration(links.Nanotime() - int64(hb))
+	}
+	mnt.Seek(offClosed, 0)
+	closed, _ := mnt.AtomicReadUint32()
+	info.Closed = closed != 0
+	info.Version, _ = mnt.AtomicReadUint32()
+	mnt.Seek(offFeatures, 0)
+	info.Features, _ = mnt.AtomicReadUint32()
+
+	commit, _ := mnt.AtomicReadUint64At(offCommit)
+	info.Seq = commit >> 1
+	mnt.Seek(offWriterPID, 0)
+	pid, _ := mnt.AtomicReadUint32()
+	info.WriterPID = int(pid)
+	mnt.Seek(offKey, 0)
+	key, _ := mnt.AtomicReadUint32()
+	info.PipeKey = int64(int32(key))
+	info.Epoch, _ = mnt.AtomicReadUint32()
+	readers, _ := mnt.AtomicReadUint64At(offReaders)
+	info.Readers = uint32(readers)
+	return info, nil
+}
+
+// processAlive reports whether pid exists, possibly owned by another user.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,128 @@
+package conn
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Exca-DK/go-mempipe/core/primitives"
+)
+
+func TestSegments(t *testing.T) {
+	const key = 0xE4CAE
+
+	w, err := NewMemWritePipe(key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	info, err := StatSegment(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 4096 || info.CreatorPID != os.Getpid() || info.Attaches != 1 {
+		t.Fatalf("wrong segment info: %+v", info)
+	}
+	if info.Removed() || info.Stale(StaleAfter) || info.Closed || info.Heartbeat < 0 {
+		t.Fatalf("live segment reported as removed or stale: %+v", info)
+	}
+
+	segments, err := Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, s := range segments {
+		found = found || s.Key == key
+	}
+	if !found {
+		t.Fatal("segment not listed")
+	}
+
+	removed, err := CollectSegments(StaleAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range removed {
+		if s.Key == key {
+			t.Fatal("live segment collected")
+		}
+	}
+
+	if err := RemoveSegment(key); err != nil {
+		t.Fatal(err)
+	}
+	// still found by key while the writer is attached
+	if info, err := StatSegment(key); err != nil || !info.Removed() || info.PipeKey != key {
+		t.Fatalf("removed segment not found: %+v, %v", info, err)
+	}
+	w.Close()
+	if _, err := StatSegment(key); !errors.Is(err, ErrSegmentNotFound) {
+		t.Fatalf("expected %v, got %v", ErrSegmentNotFound, err)
+	}
+}
+
+func TestStatForeignSegment(t *testing.T) {
+	conn := connSetup(t, true, 4096)
+	defer conn.Close()
+	defer conn.mem.Remove()
+
+	if _, err := StatSegment(0xE4CAB); !errors.Is(err, ErrNotPipeSegment) {
+		t.Fatalf("expected %v, got %v", ErrNotPipeSegment, err)
+	}
+}
+
+func TestReclaim(t *testing.T) {
+	const key = 0xE4CB0
+
+	w, err := NewMemWritePipe(key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := Reclaim(key); ok || err != nil {
+		t.Fatalf("live segment reclaimed: %v %v", ok, err)
+	}
+
+	// closed without a reader ever attaching, the segment stays behind
+	w.Close()
+	if _, err := NewMemWritePipe(key, 4096); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected %v, got %v", os.ErrExist, err)
+	}
+	info, err := StatSegment(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Closed || !info.Stale(StaleAfter) {
+		t.Fatalf("closed segment not stale: %+v", info)
+	}
+
+	if ok, err := Reclaim(key); !ok || err != nil {
+		t.Fatalf("stale segment not reclaimed: %v %v", ok, err)
+	}
+	w, err = NewMemWritePipe(key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	Reclaim(key)
+}
+
+func TestStale(t *testing.T) {
+	alive := primitives.Segment{CreatorPID: os.Getpid()}
+	for _, tc := range []struct {
+		info  SegmentInfo
+		stale bool
+	}{
+		{SegmentInfo{Segment: alive, Heartbeat: time.Second}, false},
+		{SegmentInfo{Segment: alive, Heartbeat: -1}, false},
+		{SegmentInfo{Segment: alive, Heartbeat: 2 * StaleAfter}, true},
+		{SegmentInfo{Segment: alive, Closed: true}, true},
+		{SegmentInfo{Segment: primitives.Segment{CreatorPID: os.Getpid(), Attaches: 1}, Closed: true}, false},
+	} {
+		if got := tc.info.Stale(StaleAfter); got != tc.stale {
+			t.Errorf("%+v: stale %v, want %v", tc.info, got, tc.stale)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package conn
+
+import (
+	"fmt"
+	"io"
+)
+
+// StreamWriter turns a write pipe into an io.WriteCloser. Writes are chunked
+// into frames as large as the segment allows.
+type StreamWriter struct {
+	p *pipe
+}
+
+func NewStreamWriter(p Pipe) (*StreamWriter, error) {
+	raw, err := pipeOf(p)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamWriter{p: raw}, nil
+}
+
+func (w *StreamWriter) Write(b []byte) (int, error) {
+	w.p.wmu.Lock()
+	defer w.p.wmu.Unlock()
+
+	max := w.p.conn.maxPayload()
+	n := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		if _, err := w.p.conn.Write(streamDataCode, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// ReadFrom reads from r straight into the segment, one frame per read.
+func (w *StreamWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.p.wmu.Lock()
+	defer w.p.wmu.Unlock()
+
+	var total int64
+	for {
+		n, err := w.p.conn.writeFrom(streamDataCode, r.Read)
+		total += int64(n)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Close signals the end of the stream to the reader. The pipe stays open.
+func (w *StreamWriter) Close() error {
+	w.p.wmu.Lock()
+	defer w.p.wmu.Unlock()
+
+	_, err := w.p.conn.Write(streamEOFCode, nil)
+	return err
+}
+
+// StreamReader turns a read pipe into an io.Reader serving bytes across frame boundaries.
+type StreamReader struct {
+	p   *pipe
+	buf []byte // unread part of the current frame, valid until the next frame is read
+	eof bool
+}
+
+func NewStreamReader(p Pipe) (*StreamReader, error) {
+	raw, err := pipeOf(p)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamReader{p: raw}, nil
+}
+
+func (r *StreamReader) Read(b []byte) (int, error) {
+	r.p.rmu.Lock()
+	defer r.p.rmu.Unlock()
+
+	for len(r.buf) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+
+		f, err := r.p.conn.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		if err := r.handle(f); err != nil {
+			return 0, err
+		}
+		r.buf = f.payload
+	}
+
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// WriteTo writes every frame to w directly from the segment until the end of the stream.
+func (r *StreamReader) WriteTo(w io.Writer) (int64, error) {
+	r.p.rmu.Lock()
+	defer r.p.rmu.Unlock()
+
+	var total int64
+	if len(r.buf) > 0 {
+		n, err := w.Write(r.buf)
+		total += int64(n)
+		r.buf = r.buf[n:]
+		if err != nil {
+			return total, err
+		}
+	}
+
+	for !r.eof {
+		err := r.p.conn.readFunc(func(f frame) error {
+			if err := r.handle(f); err != nil {
+				return err
+			}
+			n, err := w.Write(f.payload)
+			total += int64(n)
+			return err
+		})
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (r *StreamReader) handle(f frame) error {
+	switch f.code {
+	case streamDataCode:
+		return nil
+	case streamEOFCode:
+		r.eof = true
+		return nil
+	default:
+		return fmt.Errorf("%w: %v", errUnexpectedCode, f.code)
+	}
+}
@@ -0,0 +1,155 @@
+package conn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+)
+
+func streamSetup(t *testing.T) (*StreamWriter, *StreamReader, func()) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	conn1.updateAttach(conn1.readers())
+
+	wp, rp := newMemPipe(conn1), newMemPipe(conn2)
+	wp.SetWriteDeadline(5 * time.Second)
+	rp.SetReadDeadline(5 * time.Second)
+
+	w, err := NewStreamWriter(wp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewStreamReader(rp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, r, func() {
+		conn2.Close()
+		conn1.Close()
+	}
+}
+
+func TestStreamReadWrite(t *testing.T) {
+	w, r, teardown := streamSetup(t)
+	defer teardown()
+
+	data := make([]byte, 100*1024+17)
+	rand.Read(data)
+
+	errCh := make(chan error, 1)
+	go func() {
+		if _, err := w.Write(data); err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- w.Close()
+	}()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("diff data. got %v bytes, want %v bytes", len(got), len(data))
+	}
+}
+
+func TestStreamWriteSections(t *testing.T) {
+	w, r, teardown := streamSetup(t)
+	defer teardown()
+	// chunks leave room for the sections added to every frame
+	if err := w.p.SetChecksums(true); err != nil {
+		t.Fatal(err)
+	}
+	w.p.SetSendTimestamps(true)
+
+	data := make([]byte, 3*4096)
+	rand.Read(data)
+
+	errCh := make(chan error, 1)
+	go func() {
+		if _, err := w.Write(data); err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- w.Close()
+	}()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("diff data. got %v bytes, want %v bytes", len(got), len(data))
+	}
+}
+
+func TestStreamCopy(t *testing.T) {
+	w, r, teardown := streamSetup(t)
+	defer teardown()
+	// frames filled in place carry a checksum too
+	if err := w.p.SetChecksums(true); err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 100*1024+17)
+	rand.Read(data)
+
+	errCh := make(chan error, 1)
+	go func() {
+		// hide bytes.Reader's WriterTo so io.Copy goes through StreamWriter.ReadFrom
+		n, err := io.Copy(w, struct{ io.Reader }{bytes.NewReader(data)})
+		if err != nil {
+			errCh <- err
+			return
+		}
+		if n != int64(len(data)) {
+			errCh <- io.ErrShortWrite
+			return
+		}
+		errCh <- w.Close()
+	}()
+
+	var got bytes.Buffer
+	n, err := io.Copy(&got, r)
+	if err != nil {
+		t.Fatalf("copy error: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("diff data. got %v bytes, want %v bytes", n, len(data))
+	}
+}
+
+func TestStreamBatch(t *testing.T) {
+	w, r, teardown := streamSetup(t)
+	defer teardown()
+
+	// chunks packed into one frame are copied out one by one
+	msgs := []Msg{
+		NewMessage(uint64(streamDataCode), []byte("first "), 6),
+		NewMessage(uint64(streamDataCode), []byte("second"), 6),
+		NewMessage(uint64(streamEOFCode), nil, 0),
+	}
+	if _, err := w.p.WriteBatch(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	var got bytes.Buffer
+	if _, err := r.WriteTo(&got); err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if got.String() != "first second" {
+		t.Fatalf("diff data. got %q", got.String())
+	}
+}
@@ -0,0 +1,162 @@
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+var (
+	ErrLayoutMismatch = errors.New("struct layout mismatch")
+	ErrNotPlainData   = errors.New("type is not plain old data")
+
+	errUnsupportedPipe = errors.New("unsupported pipe implementation")
+	errUnexpectedCode  = errors.New("unexpected message code")
+)
+
+// StructWriter copies fixed-size values of T straight into the shared segment.
+// T must not contain pointers, slices, strings, maps, channels, funcs or interfaces.
+type StructWriter[T any] struct {
+	p *pipe
+}
+
+// NewStructWriter wraps the write pipe and announces the layout of T to the reader.
+func NewStructWriter[T any](p Pipe) (*StructWriter[T], error) {
+	raw, err := pipeOf(p)
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := layoutOf[T]()
+	if err != nil {
+		return nil, err
+	}
+
+	raw.wmu.Lock()
+	defer raw.wmu.Unlock()
+	if _, err := raw.conn.Write(structLayoutCode, layout); err != nil {
+		return nil, err
+	}
+	return &StructWriter[T]{p: raw}, nil
+}
+
+// Write copies the bytes of v into the segment.
+func (w *StructWriter[T]) Write(v *T) error {
+	w.p.wmu.Lock()
+	defer w.p.wmu.Unlock()
+
+	_, err := w.p.conn.Write(structDataCode, valueBytes(v))
+	return err
+}
+
+// StructReader reads values written by a StructWriter of the same layout.
+type StructReader[T any] struct {
+	p *pipe
+}
+
+// NewStructReader waits for the writer's layout announcement and rejects
+// it with ErrLayoutMismatch if it differs from the local layout of T.
+func NewStructReader[T any](p Pipe) (*StructReader[T], error) {
+	raw, err := pipeOf(p)
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := layoutOf[T]()
+	if err != nil {
+		return nil, err
+	}
+
+	raw.rmu.Lock()
+	defer raw.rmu.Unlock()
+	code, data, _, err := raw.conn.Read()
+	if err != nil {
+		return nil, err
+	}
+	if code != structLayoutCode {
+		return nil, fmt.Errorf("%w: %v", errUnexpectedCode, code)
+	}
+	if !bytes.Equal(data, layout) {
+		return nil, ErrLayoutMismatch
+	}
+	return &StructReader[T]{p: raw}, nil
+}
+
+// Read copies the next value from the segment into v.
+func (r *StructReader[T]) Read(v *T) error {
+	r.p.rmu.Lock()
+	defer r.p.rmu.Unlock()
+
+	f, err := r.p.conn.readFrameInto(valueBytes(v))
+	if err != nil {
+		return err
+	}
+	if f.code != structDataCode {
+		return fmt.Errorf("%w: %v", errUnexpectedCode, f.code)
+	}
+	return nil
+}
+
+func pipeOf(p Pipe) (*pipe, error) {
+	raw, ok := p.(*pipe)
+	if !ok {
+		return nil, errUnsupportedPipe
+	}
+	return raw, nil
+}
+
+func valueBytes[T any](v *T) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(v)), unsafe.Sizeof(*v))
+}
+
+// layoutOf fingerprints the memory layout of T: its size and alignment
+// followed by offset, size and kind of every scalar it is made of.
+func layoutOf[T any]() ([]byte, error) {
+	var zero T
+	typ := reflect.TypeOf(zero)
+	if typ == nil {
+		return nil, ErrNotPlainData
+	}
+
+	buf := appendLayoutUint32(nil, uint32(typ.Size()))
+	buf = appendLayoutUint32(buf, uint32(typ.Align()))
+	return appendLayout(buf, typ, 0)
+}
+
+func appendLayout(buf []byte, typ reflect.Type, offset uintptr) ([]byte, error) {
+	switch typ.Kind() {
+	case reflect.Struct:
+		var err error
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if buf, err = appendLayout(buf, f.Type, offset+f.Offset); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Array:
+		// elements share one layout, describe it once relative to the array
+		buf = appendLayoutUint32(buf, uint32(offset))
+		buf = appendLayoutUint32(buf, uint32(typ.Len()))
+		buf = append(buf, byte(reflect.Array))
+		return appendLayout(buf, typ.Elem(), 0)
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		buf = appendLayoutUint32(buf, uint32(offset))
+		buf = appendLayoutUint32(buf, uint32(typ.Size()))
+		return append(buf, byte(typ.Kind())), nil
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrNotPlainData, typ)
+	}
+}
+
+func appendLayoutUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
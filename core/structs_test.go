@@ -0,0 +1,166 @@
+package conn
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+type tick struct {
+	Ts     int64
+	Price  float64
+	Volume uint32
+	Side   byte
+	Venue  [6]byte
+}
+
+type tickV2 struct {
+	Ts     int64
+	Price  float64
+	Volume uint64
+	Side   byte
+	Venue  [6]byte
+}
+
+func TestStructPipe(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	wp := newMemPipe(conn1)
+	writer, err := NewStructWriter[tick](wp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewStructReader[tick](newMemPipe(conn2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			if err := wp.SetChecksums(true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		src := tick{Ts: int64(i), Price: float64(i) / 3, Volume: uint32(i * 10), Side: 'B', Venue: [6]byte{'X', 'N', 'A', 'S'}}
+		if err := writer.Write(&src); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+
+		var dst tick
+		if err := reader.Read(&dst); err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		if dst != src {
+			t.Fatalf("diff value. got: %+v, want: %+v", dst, src)
+		}
+	}
+}
+
+func TestStructSizeMismatch(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	writer, err := NewStructWriter[tick](newMemPipe(conn1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewStructReader[tick](newMemPipe(conn2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.p.SetReadDeadline(time.Second)
+
+	src := tick{Ts: 1, Price: 2, Volume: 3, Side: 'S'}
+	// frames shorter and longer than a tick are dropped, the next one is read
+	for _, n := range []int{3, int(unsafe.Sizeof(src)) + 1} {
+		if _, err := conn1.Write(structDataCode, make([]byte, n)); err != nil {
+			t.Fatal(err)
+		}
+		var dst tick
+		if err := reader.Read(&dst); !errors.Is(err, errFrameSizeMismatch) {
+			t.Fatalf("expected %v, got %v", errFrameSizeMismatch, err)
+		}
+
+		if err := writer.Write(&src); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+		if err := reader.Read(&dst); err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		if dst != src {
+			t.Fatalf("diff value. got: %+v, want: %+v", dst, src)
+		}
+	}
+}
+
+func TestStructBatch(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	if _, err := NewStructWriter[tick](newMemPipe(conn1)); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewStructReader[tick](newMemPipe(conn2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.p.SetReadDeadline(time.Second)
+
+	// values packed into one frame are read one by one
+	src := []tick{{Ts: 1, Side: 'B'}, {Ts: 2, Side: 'S'}}
+	msgs := make([]Msg, len(src))
+	for i := range src {
+		msgs[i] = NewMessage(uint64(structDataCode), valueBytes(&src[i]), int(unsafe.Sizeof(src[i])))
+	}
+	if _, err := newMemPipe(conn1).WriteBatch(msgs); err != nil {
+		t.Fatal(err)
+	}
+	for i := range src {
+		var dst tick
+		if err := reader.Read(&dst); err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		if dst != src[i] {
+			t.Fatalf("diff value. got: %+v, want: %+v", dst, src[i])
+		}
+	}
+}
+
+func TestStructLayoutMismatch(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+
+	if _, err := NewStructWriter[tick](newMemPipe(conn1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewStructReader[tickV2](newMemPipe(conn2)); !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected layout mismatch, got: %v", err)
+	}
+}
+
+func TestStructNotPlainData(t *testing.T) {
+	type withSlice struct {
+		Ts   int64
+		Data []byte
+	}
+
+	if _, err := layoutOf[withSlice](); !errors.Is(err, ErrNotPlainData) {
+		t.Fatalf("expected not plain data error, got: %v", err)
+	}
+	if _, err := layoutOf[*tick](); !errors.Is(err, ErrNotPlainData) {
+		t.Fatalf("expected not plain data error, got: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package conn
+
+import (
+	"time"
+
+	"github.com/Exca-DK/go-mempipe/core/links"
+	"github.com/Exca-DK/go-mempipe/core/primitives"
+)
+
+// Tap observes the frames published on a live segment without acknowledging them,
+// so the writer and its readers are not affected. The writer may reuse the slot
+// as soon as the real readers acknowledged a frame, frames the tap could not copy
+// in time are skipped and counted by Missed.
+//
+// A tap attaches to the segment but doesn't count itself among the readers in the
+// segment header, the writer doesn't wait for it.
+type Tap struct {
+	mnt *primitives.SharedMemMount
+
+	wc       uint32
+	seq      uint64 // of the last message observed
+	missed   uint64
+	rbuf     readBuffer
+	deadline time.Duration
+
+	// messages of the last batch copied, handed out from next
+	frames []frame
+	next   int
+}
+
+// NewTap attaches read-only to the segment described by s, as returned by StatSegment.
+// Only frames published from now on are observed.
+func NewTap(s SegmentInfo) (*Tap, error) {
+	mnt, err := primitives.OpenSharedMem(s.ID, s.Size).Attach(&primitives.SHMAttachFlags{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkSegment(mnt); err != nil {
+		mnt.Close()
+		return nil, err
+	}
+
+	mnt.Seek(offSendCounter, 0)
+	wc, err := mnt.AtomicReadUint32()
+	if err != nil {
+		mnt.Close()
+		return nil, err
+	}
+	return &Tap{mnt: mnt, wc: wc, deadline: -1}, nil
+}
+
+// ReadMsg waits for the next frame published after the previous one returned.
+// The payload is valid until the next call to ReadMsg.
+func (t *Tap) ReadMsg() (Msg, error) {
+	ts := time.Now()
+	for i := 1; ; i++ {
+		msg, ok, err := t.tryRead()
+		if err != nil || ok {
+			return msg, err
+		}
+
+		if i%1000 == 0 && t.deadline != -1 && time.Since(ts) > t.deadline {
+			return Msg{}, ErrReadTimedout
+		}
+		links.Wait()
+	}
+}
+
+// tryRead copies the frame in the slot if one was published since the last call.
+// The copy is only kept if the writer did not start on the next frame meanwhile.
+func (t *Tap) tryRead() (Msg, bool, error) {
+	if t.next < len(t.frames) {
+		t.next++
+		return msgFromFrame(&t.frames[t.next-1]), true, nil
+	}
+
+	t.mnt.Seek(offSendCounter, 0)
+	wc, err := t.mnt.AtomicReadUint32()
+	if err != nil || wc == t.wc {
+		return Msg{}, false, err
+	}
+	now := links.Nanotime()
+	t.missed += uint64(wc - t.wc - 1)
+	t.wc = wc
+
+	if !t.holds(wc) {
+		t.missed++
+		return Msg{}, false, nil
+	}
+
+	t.mnt.Seek(offSizeWord, 0)
+	word, err := t.mnt.AtomicReadUint32()
+	if err != nil {
+		return Msg{}, false, err
+	}
+	size, flags := unpackSizeWord(word)
+	commit, _ := t.mnt.AtomicReadUint64At(offCommit)
+	if size < 4 || size > int(t.mnt.Size())-offCode {
+		t.missed++
+		return Msg{}, false, nil
+	}
+
+	data, err := t.rbuf.read(t.mnt, size)
+	if err != nil {
+		return Msg{}, false, err
+	}
+
+	if !t.holds(wc) {
+		t.missed++
+		return Msg{}, false, nil
+	}
+
+	if flags&frameFlagBatch != 0 {
+		if t.frames, err = decodeBatch(data, t.frames[:0]); err != nil {
+			t.frames = t.frames[:0]
+			return Msg{}, false, err
+		}
+	} else {
+		f, err := decodeFrame(data, flags)
+		if err != nil {
+			return Msg{}, false, err
+		}
+		t.frames = append(t.frames[:0], f)
+	}
+
+	seq := commit>>1 - uint64(len(t.frames)) + 1
+	t.next = 0
+	for i := range t.frames {
+		t.frames[i].receivedAt = now
+		t.frames[i].seq = seq + uint64(i)
+		// a ring frame carries on the messages of the frame it replaced
+		if t.seq != 0 && commit>>1 != 0 && t.frames[i].seq <= t.seq {
+			t.next = i + 1
+		}
+	}
+	if commit>>1 != 0 {
+		t.seq = commit >> 1
+	}
+	if t.next == len(t.frames) {
+		return Msg{}, false, nil
+	}
+	t.next++
+	return msgFromFrame(&t.frames[t.next-1]), true, nil
+}
+
+// holds reports whether the slot still holds frame wc.
+func (t *Tap) holds(wc uint32) bool {
+	t.mnt.Seek(offSlotSeq, 0)
+	seq, err := t.mnt.AtomicReadUint32()
+	if err != nil || seq != wc {
+		return false
+	}
+	t.mnt.Seek(offSendCounter, 0)
+	cur, err := t.mnt.AtomicReadUint32()
+	return err == nil && cur == wc
+}
+
+// Missed returns how many frames were published but not observed.
+func (t *Tap) Missed() uint64 {
+	return t.missed
+}
+
+func (t *Tap) SetReadDeadline(d time.Duration) {
+	t.deadline = d
+}
+
+// Close detaches from the segment.
+func (t *Tap) Close() error {
+	return t.mnt.Close()
+}
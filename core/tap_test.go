@@ -0,0 +1,155 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTap(t *testing.T) {
+	const key = 0xE4CAF
+
+	w, err := NewMemWritePipe(key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	info, err := StatSegment(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewMemReadPipe(key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w.WaitConn()
+
+	if _, err := StatSegmentID(info.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tap, err := NewTap(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tap.Close()
+	tap.SetReadDeadline(100 * time.Millisecond)
+
+	write := func(code uint64, payload string) {
+		if err := w.WriteMsg(NewMessage(code, []byte(payload), len(payload))); err != nil {
+			t.Fatalf("write msg error: %v", err)
+		}
+	}
+	read := func(code uint64) {
+		msg, err := r.ReadMsg()
+		if err != nil || msg.Code != code {
+			t.Fatalf("read msg: code %v, err %v", msg.Code, err)
+		}
+	}
+
+	write(1, "first")
+	msg, err := tap.ReadMsg()
+	if err != nil {
+		t.Fatalf("tap read error: %v", err)
+	}
+	if msg.Code != 1 || string(msg.Payload) != "first" {
+		t.Fatalf("diff msg. got: %v %q", msg.Code, msg.Payload)
+	}
+	// the tap did not acknowledge, the reader still gets the frame
+	read(1)
+
+	write(2, "second")
+	read(2)
+	write(3, "third")
+	if msg, err = tap.ReadMsg(); err != nil || msg.Code != 3 {
+		t.Fatalf("tap read: code %v, err %v", msg.Code, err)
+	}
+	if tap.Missed() != 1 {
+		t.Fatalf("wrong missed count: %v", tap.Missed())
+	}
+	read(3)
+
+	// the messages of a batch are observed one by one
+	batch := []Msg{NewMessage(4, []byte("a"), 1), NewMessage(5, []byte("b"), 1)}
+	if _, err := w.(BatchWriter).WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []uint64{4, 5} {
+		if msg, err = tap.ReadMsg(); err != nil || msg.Code != code || msg.Seq != code {
+			t.Fatalf("tap read: code %v seq %v, err %v", msg.Code, msg.Seq, err)
+		}
+	}
+	read(4)
+	read(5)
+
+	// a ring frame repeats the unread messages of the frame it replaced, the tap skips them
+	if err := w.(WritePolicySetter).SetWritePolicy(WriteRing, 0); err != nil {
+		t.Fatal(err)
+	}
+	write(6, "sixth")
+	if msg, err = tap.ReadMsg(); err != nil || msg.Code != 6 {
+		t.Fatalf("tap read: code %v, err %v", msg.Code, err)
+	}
+	write(7, "seventh")
+	if msg, err = tap.ReadMsg(); err != nil || msg.Code != 7 || msg.Seq != 7 {
+		t.Fatalf("tap read: code %v seq %v, err %v", msg.Code, msg.Seq, err)
+	}
+	read(6)
+	read(7)
+
+	if _, err := tap.ReadMsg(); err != ErrReadTimedout {
+		t.Fatalf("expected %v, got %v", ErrReadTimedout, err)
+	}
+}
+
+func TestTapNotCounted(t *testing.T) {
+	const key = 0xE4CB9
+
+	w, err := NewReconnectingWritePipe(key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	r, err := NewReconnectingReadPipe(key, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w.WaitConn()
+
+	info, err := StatSegment(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tap, err := NewTap(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tap.Close()
+
+	// the tap attached, only the reader is waited for
+	if n := w.conn.readers(); n != 1 {
+		t.Fatalf("expected 1 reader, got %v", n)
+	}
+	if info, err = StatSegment(key); err != nil || info.Readers != 1 || info.Attaches != 3 {
+		t.Fatalf("expected 1 reader of 3 attaches, got %+v: %v", info, err)
+	}
+	w.conn.updateAttach(w.conn.readers())
+
+	w.SetWriteDeadline(time.Second)
+	for i := uint64(1); i <= 3; i++ {
+		if err := w.WriteMsg(NewMessage(i, []byte("x"), 1)); err != nil {
+			t.Fatalf("write msg %v error: %v", i, err)
+		}
+		if msg, err := r.ReadMsg(); err != nil || msg.Code != i {
+			t.Fatalf("read msg: code %v, err %v", msg.Code, err)
+		}
+	}
+
+	r.Close()
+	if n := w.conn.readers(); n != 0 {
+		t.Fatalf("expected no readers after close, got %v", n)
+	}
+}
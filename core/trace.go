@@ -0,0 +1,101 @@
+package conn
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var errInvalidTraceparent = errors.New("invalid traceparent")
+
+// size of the trace section of a frame: trace id, span id and flags
+const traceLen = 16 + 8 + 1
+
+// SpanContext is the part of a span that travels with a message,
+// laid out like a W3C traceparent.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+// IsValid reports whether both ids are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Sampled reports whether the sampled flag is set.
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&1 != 0
+}
+
+// Traceparent formats sc as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), sc.Flags)
+}
+
+// ParseTraceparent parses a traceparent header value.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' || s[:2] == "ff" {
+		return sc, errInvalidTraceparent
+	}
+	// later versions may append fields
+	if s[:2] == "00" && len(s) != 55 {
+		return sc, errInvalidTraceparent
+	}
+
+	var flags [1]byte
+	if _, err := hex.Decode(sc.TraceID[:], []byte(s[3:35])); err != nil {
+		return sc, errInvalidTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(s[36:52])); err != nil {
+		return sc, errInvalidTraceparent
+	}
+	if _, err := hex.Decode(flags[:], []byte(s[53:55])); err != nil {
+		return sc, errInvalidTraceparent
+	}
+	sc.Flags = flags[0]
+
+	if !sc.IsValid() {
+		return sc, errInvalidTraceparent
+	}
+	return sc, nil
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying sc.
+func ContextWithSpan(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanFromContext returns the span context stored by ContextWithSpan.
+func SpanFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Tracer bridges pipes and a tracing stack.
+type Tracer interface {
+	// Inject returns the span context to send along with a message written under ctx.
+	// An invalid span context sends nothing.
+	Inject(ctx context.Context) SpanContext
+
+	// Extract returns ctx carrying the span context received with a message.
+	Extract(ctx context.Context, sc SpanContext) context.Context
+}
+
+// ContextTracer propagates the span context stored with ContextWithSpan.
+// Pipes use it until SetTracer is called.
+type ContextTracer struct{}
+
+func (ContextTracer) Inject(ctx context.Context) SpanContext {
+	sc, _ := SpanFromContext(ctx)
+	return sc
+}
+
+func (ContextTracer) Extract(ctx context.Context, sc SpanContext) context.Context {
+	return ContextWithSpan(ctx, sc)
+}
@@ -0,0 +1,95 @@
+package conn
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	sc, err := ParseTraceparent(tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sc.Sampled() || sc.Traceparent() != tp {
+		t.Fatalf("wrong round trip: %v", sc.Traceparent())
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceparent(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+// recordingTracer stands in for a tracing stack: it reports the span it saw and starts a child on read.
+type recordingTracer struct {
+	extracted []SpanContext
+}
+
+func (r *recordingTracer) Inject(ctx context.Context) SpanContext {
+	sc, _ := SpanFromContext(ctx)
+	return sc
+}
+
+func (r *recordingTracer) Extract(ctx context.Context, sc SpanContext) context.Context {
+	r.extracted = append(r.extracted, sc)
+	child := sc
+	child.SpanID = [8]byte{9, 9, 9, 9, 9, 9, 9, 9}
+	return ContextWithSpan(ctx, child)
+}
+
+func TestTracePropagation(t *testing.T) {
+	conn1 := connSetup(t, true, 4096)
+	conn2 := connSetup(t, false, 4096)
+	defer conn2.Close()
+	defer conn1.Close()
+	conn1.updateAttach(conn1.readers())
+
+	pipeWriter := newMemPipe(conn1)
+	pipeRecv := newMemPipe(conn2)
+	tracer := &recordingTracer{}
+	pipeRecv.SetTracer(tracer)
+
+	sc, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	payload := []byte("traced")
+	if err := pipeWriter.WriteMsgContext(ContextWithSpan(context.Background(), sc), NewMessage(1, payload, len(payload))); err != nil {
+		t.Fatalf("write msg error: %v", err)
+	}
+
+	ctx, msg, err := pipeRecv.ReadMsgContext(context.Background())
+	if err != nil {
+		t.Fatalf("read msg error: %v", err)
+	}
+	if msg.Trace != sc || string(msg.Payload) != string(payload) {
+		t.Fatalf("diff msg. got: %v %q, want: %v", msg.Trace.Traceparent(), msg.Payload, sc.Traceparent())
+	}
+	if len(tracer.extracted) != 1 || tracer.extracted[0] != sc {
+		t.Fatalf("tracer did not see the span: %v", tracer.extracted)
+	}
+	if got, _ := SpanFromContext(ctx); got.TraceID != sc.TraceID || got.SpanID == sc.SpanID {
+		t.Fatalf("context does not carry the child span: %v", got.Traceparent())
+	}
+
+	// without a span in the context the frame carries none
+	if err := pipeWriter.WriteMsgContext(context.Background(), NewMessage(2, payload, len(payload))); err != nil {
+		t.Fatalf("write msg error: %v", err)
+	}
+	ctx, msg, err = pipeRecv.ReadMsgContext(context.Background())
+	if err != nil {
+		t.Fatalf("read msg error: %v", err)
+	}
+	if msg.Trace.IsValid() || len(tracer.extracted) != 1 {
+		t.Fatalf("unexpected span: %v", msg.Trace.Traceparent())
+	}
+	if _, ok := SpanFromContext(ctx); ok {
+		t.Fatal("unexpected span in context")
+	}
+}